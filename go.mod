@@ -1,23 +1,80 @@
 module github.com/SmartEnergyPlatform/platform-connector
 
+go 1.17
+
 require (
-	github.com/Shopify/sarama v0.0.0-20180104135601-f0c32558d5e8
+	github.com/Shopify/sarama v1.38.1
 	github.com/SmartEnergyPlatform/amqp-wrapper-lib v0.0.0-20181018071408-32e07d9d89bb
 	github.com/SmartEnergyPlatform/formatter-lib v0.0.0-20181018082014-b45c9317bb5e
 	github.com/SmartEnergyPlatform/iot-device-repository v0.0.0-20181018081528-7297409a5f9f
 	github.com/cbroglie/mustache v1.0.1
-	github.com/davecgh/go-spew v0.0.0-20171005155431-ecdeabc65495
-	github.com/eapache/go-resiliency v0.0.0-20180101203313-ef9aaa7ea8bd
-	github.com/eapache/go-xerial-snappy v0.0.0-20160609142408-bb955e01b934
+	github.com/davecgh/go-spew v1.1.1
+	github.com/eapache/go-resiliency v1.3.0
+	github.com/eapache/go-xerial-snappy v0.0.0-20230111030713-bf00bc1b83b6
 	github.com/eapache/queue v1.1.0
-	github.com/golang/snappy v0.0.0-20170215233205-553a64147049
-	github.com/gorilla/websocket v1.2.0
+	github.com/eclipse/paho.mqtt.golang v1.4.2
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/golang/snappy v0.0.4
+	github.com/gorilla/websocket v1.4.2
 	github.com/pierrec/lz4 v0.0.0-20171218195038-2fcda4cb7018
 	github.com/pierrec/xxHash v0.0.0-20170714082455-a0006b13c722
-	github.com/rcrowley/go-metrics v0.0.0-20171128170426-e181e095bae9
+	github.com/prometheus/client_golang v1.14.0
+	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
 	github.com/samuel/go-zookeeper v0.0.0-20171117190445-471cd4e61d7a
 	github.com/satori/go.uuid v1.2.0
 	github.com/streadway/amqp v0.0.0-20180315184602-8e4aba63da9f
-	github.com/wvanbergen/kafka v0.0.0-20171203153745-e2edea948ddf
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	github.com/wvanbergen/kazoo-go v0.0.0-20171110111202-494a179ad10a
+	github.com/xdg-go/scram v1.1.2
+)
+
+require (
+	github.com/Azure/go-ansiterm v0.0.0-20170929234023-d6e3b3328b78 // indirect
+	github.com/Microsoft/go-winio v0.4.8 // indirect
+	github.com/Nvveen/Gotty v0.0.0-20120604004816-cd527374f1e5 // indirect
+	github.com/SmartEnergyPlatform/jwt-http-router v0.0.0-20181018071703-2fca7308e21f // indirect
+	github.com/SmartEnergyPlatform/util v0.0.0-20181018070938-b26ca656886c // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/bouk/monkey v0.0.0-20170901202551-b96e337f6e5b // indirect
+	github.com/cenkalti/backoff v2.0.0+incompatible // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/containerd/continuity v0.0.0-20180612233548-246e49050efd // indirect
+	github.com/dgrijalva/jwt-go v3.1.0+incompatible // indirect
+	github.com/docker/go-connections v0.3.0 // indirect
+	github.com/docker/go-units v0.3.3 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	github.com/hashicorp/go-uuid v1.0.3 // indirect
+	github.com/jcmturner/aescts/v2 v2.0.0 // indirect
+	github.com/jcmturner/dnsutils/v2 v2.0.0 // indirect
+	github.com/jcmturner/gofork v1.7.6 // indirect
+	github.com/jcmturner/gokrb5/v8 v8.4.3 // indirect
+	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
+	github.com/klauspost/compress v1.15.14 // indirect
+	github.com/knakk/digest v0.0.0-20160404164910-fd45becddc49 // indirect
+	github.com/knakk/rdf v0.0.0-20171130200148-b6ee24f8f40f // indirect
+	github.com/knakk/sparql v0.0.0-20170625101756-3de19ad6a5dc // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/opencontainers/go-digest v1.0.0-rc1 // indirect
+	github.com/opencontainers/image-spec v1.0.1 // indirect
+	github.com/opencontainers/runc v0.1.1 // indirect
+	github.com/ory/dockertest v3.3.2+incompatible // indirect
+	github.com/pierrec/lz4/v4 v4.1.17 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.37.0 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
+	github.com/sirupsen/logrus v1.6.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa // indirect
+	golang.org/x/net v0.5.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+	golang.org/x/text v0.6.0 // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
 )
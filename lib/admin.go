@@ -0,0 +1,166 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/model"
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+type SessionInfo struct {
+	Id                string                               `json:"id"`
+	User              string                               `json:"user"`
+	Gateway           string                               `json:"gateway"`
+	Prefixes          []string                             `json:"prefixes"`
+	UriCache          map[string]model.DeviceServiceEntity `json:"uri_cache"`
+	ConnectTime       time.Time                            `json:"connect_time"`
+	ConsecutiveErrors int64                                `json:"consecutive_errors"`
+	QueueDepth        int                                  `json:"queue_depth"`
+	Encoding          string                               `json:"encoding"`
+	Traffic           TrafficStats                         `json:"traffic"`
+	ProtocolVersion   int                                  `json:"protocol_version"`
+	Capabilities      []string                             `json:"capabilities"`
+}
+
+func (session *Session) Info() (info SessionInfo) {
+	session.Mux.Lock()
+	defer session.Mux.Unlock()
+	info = SessionInfo{
+		Id:                session.Id,
+		User:              session.Cred.User,
+		Gateway:           session.Gateway,
+		Prefixes:          append([]string{}, session.Prefixes...),
+		UriCache:          map[string]model.DeviceServiceEntity{},
+		ConnectTime:       session.ConnectTime,
+		ConsecutiveErrors: session.ConsecutiveErrors,
+		QueueDepth:        session.QueueDepth(),
+		Encoding:          session.Codec().Name(),
+		Traffic:           session.traffic.Stats(),
+		ProtocolVersion:   session.ProtocolVersion,
+		Capabilities:      append([]string{}, session.Capabilities...),
+	}
+	for uri, entity := range session.UriCache {
+		info.UriCache[uri] = entity
+	}
+	return
+}
+
+// GET    /admin/sessions
+// GET    /admin/sessions/{session_id}
+// DELETE /admin/sessions/{session_id}
+// DELETE /admin/sessions/{session_id}/devices/{device_uri}
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="connector admin"`)
+		http.Error(w, "access denied", http.StatusUnauthorized)
+		return
+	}
+	parts, err := pathParts(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(parts) < 2 || parts[0] != "admin" || parts[1] != "sessions" {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		result := []SessionInfo{}
+		for _, session := range Sessions().List() {
+			result = append(result, session.Info())
+		}
+		writeJson(w, result)
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		session, ok := Sessions().Get(parts[2])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJson(w, session.Info())
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		session, ok := Sessions().Get(parts[2])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		log.Println("admin: close session", session.Id, session.Gateway)
+		session.Close("closed by admin")
+		writeJson(w, "ok")
+	case len(parts) == 5 && parts[3] == "devices" && r.Method == http.MethodDelete:
+		session, ok := Sessions().Get(parts[2])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		entity, err := session.GetEntity(parts[4])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Println("admin: mute device", session.Id, entity.Device.Id)
+		err = session.MuteEntity(entity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, "ok")
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func checkAdminAuth(r *http.Request) bool {
+	if util.Config.AdminPassword == "" {
+		return false
+	}
+	user, pw, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(util.Config.AdminUser)) == 1
+	pwOk := subtle.ConstantTimeCompare([]byte(pw), []byte(util.Config.AdminPassword)) == 1
+	return userOk && pwOk
+}
+
+// splits the path into unescaped segments; escaped slashes are part of a segment
+func pathParts(r *http.Request) (parts []string, err error) {
+	for _, part := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return parts, err
+		}
+		parts = append(parts, unescaped)
+	}
+	return parts, nil
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Println("ERROR: unable to encode response", err)
+	}
+}
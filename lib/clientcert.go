@@ -0,0 +1,184 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+// platform identity of a gateway authenticated by its client certificate
+type CertificateIdentity struct {
+	Subject string `json:"subject,omitempty"` //distinguished name or common name of the certificate subject
+	San     string `json:"san,omitempty"`     //dns name, email address or uri of the subject alternative names
+	User    string `json:"user"`
+	Gateway string `json:"gid,omitempty"` //if set, the gateway may only use this gateway id
+	Realm   string `json:"realm,omitempty"`
+}
+
+var certificateMapping []CertificateIdentity
+var certificateMappingMux sync.Mutex
+
+func ClientCertificatesEnabled() bool {
+	return util.Config.TlsClientAuth == "optional" || util.Config.TlsClientAuth == "require"
+}
+
+// loads config.TlsClientMappingFile
+func LoadCertificateMapping() error {
+	file, err := ioutil.ReadFile(util.Config.TlsClientMappingFile)
+	if err != nil {
+		return err
+	}
+	mapping := []CertificateIdentity{}
+	err = json.Unmarshal(file, &mapping)
+	if err != nil {
+		return err
+	}
+	for _, identity := range mapping {
+		if identity.User == "" || (identity.Subject == "" && identity.San == "") {
+			return errors.New("certificate mapping entries need user and subject or san")
+		}
+	}
+	certificateMappingMux.Lock()
+	certificateMapping = mapping
+	certificateMappingMux.Unlock()
+	return nil
+}
+
+func ClientTlsConfig() (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(util.Config.TlsClientCaFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no valid certificate found in TlsClientCaFile " + util.Config.TlsClientCaFile)
+	}
+	//"require" is enforced by requireClientCertificate() for the gateway endpoints; probes and metrics need no certificate
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
+
+// rejects requests without verified client certificate if config.TlsClientAuth is "require"
+func requireClientCertificate(handler http.HandlerFunc) http.HandlerFunc {
+	if util.Config.TlsClientAuth != "require" {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if clientCertificate(r) == nil {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// returns the verified client certificate of the request or nil
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+func FindCertificateIdentity(cert *x509.Certificate) (identity CertificateIdentity, err error) {
+	certificateMappingMux.Lock()
+	defer certificateMappingMux.Unlock()
+	for _, identity = range certificateMapping {
+		if identity.Subject != "" && (identity.Subject == cert.Subject.String() || identity.Subject == cert.Subject.CommonName) {
+			return identity, nil
+		}
+		if identity.San != "" && certificateHasSan(cert, identity.San) {
+			return identity, nil
+		}
+	}
+	return CertificateIdentity{}, errors.New("no identity mapped to client certificate '" + cert.Subject.String() + "'")
+}
+
+func certificateHasSan(cert *x509.Certificate, san string) bool {
+	for _, name := range cert.DNSNames {
+		if name == san {
+			return true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if email == san {
+			return true
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == san {
+			return true
+		}
+	}
+	return false
+}
+
+// the mapped identity replaces user, pw, tokens and realm of the handshake; a mapped gateway id must match the handshake
+func (this *Credentials) useCertificate(cert *x509.Certificate) error {
+	identity, err := FindCertificateIdentity(cert)
+	if err != nil {
+		return err
+	}
+	if identity.Gateway != "" {
+		if this.Gateway != "" && this.Gateway != identity.Gateway {
+			return errors.New("gateway id '" + this.Gateway + "' not allowed for client certificate")
+		}
+		this.Gateway = identity.Gateway
+	}
+	//the realm of the handshake or request is ignored; the same user name may exist in other realms
+	this.Realm = identity.Realm
+	if this.Realm == "" {
+		this.Realm = DefaultRealm()
+	}
+	this.User = identity.User
+	this.Pw = ""
+	this.AccessToken = ""
+	this.RefreshToken = ""
+	this.certificate = &identity
+	return nil
+}
+
+// obtains a token of the mapped user by token exchange with the service account;
+// fails if the auth provider does not return a token of exactly this user
+func (this *Credentials) certificateAccess() (err error) {
+	serviceToken := &OpenidToken{}
+	err = GetServiceAccountToken(this.Realm, serviceToken)
+	if err != nil {
+		metricTokenFailures.WithLabelValues("client_credentials").Inc()
+		return err
+	}
+	token := &OpenidToken{}
+	err = ExchangeToken(this.Realm, serviceToken.AccessToken, this.User, token)
+	if err != nil {
+		metricTokenFailures.WithLabelValues("token_exchange").Inc()
+		return err
+	}
+	claims, ok := unverifiedClaims(token.AccessToken)
+	if user, _ := claims["preferred_username"].(string); !ok || user != this.User {
+		metricTokenFailures.WithLabelValues("token_exchange").Inc()
+		return errors.New("token exchange did not return a token of user '" + this.User + "'")
+	}
+	this.Openid = token
+	return nil
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func withCertificateMapping(t *testing.T, mapping []CertificateIdentity) {
+	certificateMappingMux.Lock()
+	previous := certificateMapping
+	certificateMapping = mapping
+	certificateMappingMux.Unlock()
+	t.Cleanup(func() {
+		certificateMappingMux.Lock()
+		certificateMapping = previous
+		certificateMappingMux.Unlock()
+	})
+}
+
+func testCertificate(commonName string, dnsNames ...string) *x509.Certificate {
+	return &x509.Certificate{Subject: pkix.Name{CommonName: commonName, Organization: []string{"org"}}, DNSNames: dnsNames}
+}
+
+func TestFindCertificateIdentity(t *testing.T) {
+	uri, _ := url.Parse("spiffe://gateways/uri_gateway")
+	uriCert := testCertificate("unmapped")
+	uriCert.URIs = []*url.URL{uri}
+	emailCert := testCertificate("unmapped")
+	emailCert.EmailAddresses = []string{"gateway@example.com"}
+	withCertificateMapping(t, []CertificateIdentity{
+		{Subject: "CN=dn_gateway,O=org", User: "dn_user"},
+		{Subject: "cn_gateway", User: "cn_user"},
+		{San: "dns.gateway.example.com", User: "dns_user"},
+		{San: "gateway@example.com", User: "email_user"},
+		{San: "spiffe://gateways/uri_gateway", User: "uri_user"},
+	})
+	cases := []struct {
+		name string
+		cert *x509.Certificate
+		user string
+	}{
+		{name: "distinguished name", cert: testCertificate("dn_gateway"), user: "dn_user"},
+		{name: "common name", cert: testCertificate("cn_gateway"), user: "cn_user"},
+		{name: "dns san", cert: testCertificate("unmapped", "dns.gateway.example.com"), user: "dns_user"},
+		{name: "email san", cert: emailCert, user: "email_user"},
+		{name: "uri san", cert: uriCert, user: "uri_user"},
+		{name: "unmapped", cert: testCertificate("unmapped", "other.example.com"), user: ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			identity, err := FindCertificateIdentity(c.cert)
+			if c.user == "" {
+				if err == nil {
+					t.Fatal("expected error for unmapped certificate", identity)
+				}
+				return
+			}
+			if err != nil || identity.User != c.user {
+				t.Fatal("unexpected identity", identity, err)
+			}
+		})
+	}
+}
+
+func TestUseCertificate(t *testing.T) {
+	withCertificateMapping(t, []CertificateIdentity{
+		{Subject: "any_gateway", User: "any_user"},
+		{Subject: "pinned_gateway", User: "pinned_user", Gateway: "gid", Realm: "gateways"},
+	})
+	cases := []struct {
+		name       string
+		cert       *x509.Certificate
+		handshake  Credentials
+		shouldFail bool
+		expected   Credentials
+	}{
+		{
+			name:      "handshake credentials are replaced",
+			cert:      testCertificate("any_gateway"),
+			handshake: Credentials{User: "other", Pw: "pw", AccessToken: "access", RefreshToken: "refresh", Realm: "other_realm", Gateway: "own_gid"},
+			expected:  Credentials{User: "any_user", Realm: "master", Gateway: "own_gid"},
+		},
+		{
+			name:      "mapped realm and gateway",
+			cert:      testCertificate("pinned_gateway"),
+			handshake: Credentials{Realm: "master"},
+			expected:  Credentials{User: "pinned_user", Realm: "gateways", Gateway: "gid"},
+		},
+		{
+			name:       "other gateway",
+			cert:       testCertificate("pinned_gateway"),
+			handshake:  Credentials{Gateway: "other_gid"},
+			shouldFail: true,
+		},
+		{
+			name:       "unmapped certificate",
+			cert:       testCertificate("unmapped"),
+			shouldFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cred := c.handshake
+			err := cred.useCertificate(c.cert)
+			if (err != nil) != c.shouldFail {
+				t.Fatal("unexpected result", err)
+			}
+			if c.shouldFail {
+				return
+			}
+			if cred.User != c.expected.User || cred.Realm != c.expected.Realm || cred.Gateway != c.expected.Gateway {
+				t.Fatal("unexpected credentials", cred.User, cred.Realm, cred.Gateway)
+			}
+			if cred.Pw != "" || cred.AccessToken != "" || cred.RefreshToken != "" || cred.certificate == nil {
+				t.Fatal("handshake secrets must not be used with a client certificate", cred)
+			}
+		})
+	}
+}
+
+func TestCertificateAccess(t *testing.T) {
+	var exchangedUser atomic.Value
+	//discoveries are cached per realm; a new realm per test run uses this server
+	realm := "certificate_realm_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + realm + "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": server.URL + "/" + realm, "token_endpoint": server.URL + "/token", "jwks_uri": server.URL + "/jwks"})
+		case "/token":
+			r.ParseForm()
+			user := "service-account"
+			if r.Form.Get("grant_type") == "urn:ietf:params:oauth:grant-type:token-exchange" {
+				user = exchangedUser.Load().(string)
+			}
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"preferred_username": user}).SignedString([]byte("secret"))
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": token, "expires_in": 300})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	withConfig(t, func(config *util.ConfigStruct) {
+		config.AuthIssuerUrl = server.URL + "/{realm}"
+		config.AuthRealms = []string{realm}
+	})
+
+	cases := []struct {
+		name          string
+		exchangedUser string
+		shouldFail    bool
+	}{
+		{name: "token of the mapped user", exchangedUser: "mapped_user"},
+		{name: "token of another user", exchangedUser: "service-account", shouldFail: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			exchangedUser.Store(c.exchangedUser)
+			cred := &Credentials{User: "mapped_user", Realm: realm}
+			err := cred.certificateAccess()
+			if (err != nil) != c.shouldFail {
+				t.Fatal("unexpected result", err)
+			}
+			if !c.shouldFail && cred.Openid == nil {
+				t.Fatal("missing token")
+			}
+		})
+	}
+}
+
+func TestRequireClientCertificate(t *testing.T) {
+	withCertificate := httptest.NewRequest(http.MethodGet, "/", nil)
+	withCertificate.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{testCertificate("gateway")}}}
+	cases := []struct {
+		mode     string
+		request  *http.Request
+		expected int
+	}{
+		{mode: "require", request: httptest.NewRequest(http.MethodGet, "/", nil), expected: http.StatusUnauthorized},
+		{mode: "require", request: withCertificate, expected: http.StatusOK},
+		{mode: "optional", request: httptest.NewRequest(http.MethodGet, "/", nil), expected: http.StatusOK},
+	}
+	for _, c := range cases {
+		withConfig(t, func(config *util.ConfigStruct) {
+			config.TlsClientAuth = c.mode
+		})
+		handler := requireClientCertificate(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		recorder := httptest.NewRecorder()
+		handler(recorder, c.request)
+		if recorder.Code != c.expected {
+			t.Fatal("unexpected status", c.mode, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// encodes and decodes the message envelopes of a session
+type Codec interface {
+	Name() string
+	FrameType() int //websocket.TextMessage or websocket.BinaryMessage
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+}
+
+var JsonCodec Codec = jsonCodec{}
+var MsgpackCodec Codec = msgpackCodec{}
+var CborCodec Codec = cborCodec{}
+
+// ordered by server preference; used as websocket subprotocols
+var codecs = []Codec{MsgpackCodec, CborCodec, JsonCodec}
+
+func CodecByName(name string) (Codec, error) {
+	if name == "" {
+		return JsonCodec, nil
+	}
+	for _, codec := range codecs {
+		if codec.Name() == strings.ToLower(name) {
+			return codec, nil
+		}
+	}
+	return nil, errors.New("unknown encoding '" + name + "'")
+}
+
+func codecSubprotocols() (result []string) {
+	for _, codec := range codecs {
+		result = append(result, codec.Name())
+	}
+	return
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+//binary codecs use the json struct tags by converting values to and from generic json structures
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) Marshal(value interface{}) ([]byte, error) {
+	generic, err := toGeneric(value)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(generic)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, value interface{}) error {
+	var generic interface{}
+	err := msgpack.Unmarshal(data, &generic)
+	if err != nil {
+		return err
+	}
+	return fromGeneric(generic, value)
+}
+
+var cborDecMode, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (cborCodec) Marshal(value interface{}) ([]byte, error) {
+	generic, err := toGeneric(value)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(generic)
+}
+
+func (cborCodec) Unmarshal(data []byte, value interface{}) error {
+	var generic interface{}
+	err := cborDecMode.Unmarshal(data, &generic)
+	if err != nil {
+		return err
+	}
+	return fromGeneric(generic, value)
+}
+
+// converts value to maps, slices and primitives as json would see it; integers are kept as int64
+func toGeneric(value interface{}) (result interface{}, err error) {
+	temp, err := json.Marshal(value)
+	if err != nil {
+		return result, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(temp))
+	decoder.UseNumber()
+	err = decoder.Decode(&result)
+	if err != nil {
+		return result, err
+	}
+	return normalizeNumbers(result), nil
+}
+
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, element := range v {
+			v[key] = normalizeNumbers(element)
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = normalizeNumbers(element)
+		}
+	}
+	return value
+}
+
+func fromGeneric(generic interface{}, result interface{}) error {
+	temp, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(temp, result)
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	request := RawRequest{Handler: "event", Token: "token", Payload: map[string]interface{}{"device_uri": "uri", "value": []interface{}{1.5, "text", true}}}
+	for _, codec := range []Codec{JsonCodec, MsgpackCodec, CborCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			data, err := codec.Marshal(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := RawRequest{}
+			err = codec.Unmarshal(data, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result, request) {
+				t.Fatal("unexpected result", result)
+			}
+		})
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	cases := []struct {
+		name      string
+		codec     Codec
+		frameType int
+	}{
+		{name: "", codec: JsonCodec, frameType: websocket.TextMessage},
+		{name: "json", codec: JsonCodec, frameType: websocket.TextMessage},
+		{name: "MsgPack", codec: MsgpackCodec, frameType: websocket.BinaryMessage},
+		{name: "cbor", codec: CborCodec, frameType: websocket.BinaryMessage},
+	}
+	for _, c := range cases {
+		codec, err := CodecByName(c.name)
+		if err != nil || codec != c.codec || codec.FrameType() != c.frameType {
+			t.Fatal("unexpected codec for", c.name, codec, err)
+		}
+	}
+	if _, err := CodecByName("xml"); err == nil {
+		t.Fatal("expected error for unknown encoding")
+	}
+}
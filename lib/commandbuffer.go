@@ -0,0 +1,145 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+type bufferedCommand struct {
+	prefix   string
+	msg      string
+	received time.Time
+}
+
+// holds commands for devices of recently disconnected gateways until a session listens to the device again
+type CommandBuffer struct {
+	mux          sync.Mutex
+	disconnected map[string]time.Time //prefix -> disconnect time
+	commands     map[string][]bufferedCommand
+}
+
+var commandBuffer *CommandBuffer
+var onceCommandBuffer sync.Once
+
+func Buffer() *CommandBuffer {
+	onceCommandBuffer.Do(func() {
+		commandBuffer = &CommandBuffer{
+			disconnected: map[string]time.Time{},
+			commands:     map[string][]bufferedCommand{},
+		}
+		if CommandBufferEnabled() {
+			go commandBuffer.expireLoop()
+		}
+	})
+	return commandBuffer
+}
+
+func CommandBufferEnabled() bool {
+	return util.Config.CommandBufferSize > 0 && util.Config.CommandBufferTtl > 0
+}
+
+func (this *CommandBuffer) ttl() time.Duration {
+	return time.Duration(util.Config.CommandBufferTtl) * time.Second
+}
+
+// marks the prefix as recently disconnected; following commands will be buffered
+func (this *CommandBuffer) Disconnected(prefix string) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.disconnected[prefix] = time.Now()
+}
+
+// returns false if the device is not recently disconnected;
+// commands dropped by an overflow are returned to be reported by the caller (outside of its locks)
+func (this *CommandBuffer) Add(prefix string, msg string) (buffered bool, dropped []bufferedCommand) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if _, ok := this.disconnected[prefix]; !ok {
+		return false, nil
+	}
+	commands := append(this.commands[prefix], bufferedCommand{prefix: prefix, msg: msg, received: time.Now()})
+	if overflow := len(commands) - int(util.Config.CommandBufferSize); overflow > 0 {
+		dropped = commands[:overflow]
+		commands = commands[overflow:]
+	}
+	this.commands[prefix] = commands
+	return true, dropped
+}
+
+func reportBufferOverflow(dropped []bufferedCommand) {
+	for _, command := range dropped {
+		reportBufferedCommand(command, "gateway offline; command buffer overflow")
+	}
+}
+
+// removes the disconnected mark of the prefix and returns its buffered commands in order of arrival
+func (this *CommandBuffer) Take(prefix string) (result []string) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for _, command := range this.commands[prefix] {
+		result = append(result, command.msg)
+	}
+	delete(this.commands, prefix)
+	delete(this.disconnected, prefix)
+	return
+}
+
+func (this *CommandBuffer) expireLoop() {
+	ticker := time.NewTicker(time.Second)
+	for now := range ticker.C {
+		expired, released := this.expire(now)
+		for _, command := range expired {
+			reportBufferedCommand(command, "gateway offline")
+		}
+		for _, prefix := range released {
+			Sessions().ReleasePrefix(prefix)
+		}
+	}
+}
+
+func (this *CommandBuffer) expire(now time.Time) (expired []bufferedCommand, released []string) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for prefix, commands := range this.commands {
+		remaining := []bufferedCommand{}
+		for _, command := range commands {
+			if now.Sub(command.received) > this.ttl() {
+				expired = append(expired, command)
+			} else {
+				remaining = append(remaining, command)
+			}
+		}
+		this.commands[prefix] = remaining
+	}
+	for prefix, disconnected := range this.disconnected {
+		if now.Sub(disconnected) > this.ttl() {
+			released = append(released, prefix)
+			delete(this.disconnected, prefix)
+			expired = append(expired, this.commands[prefix]...)
+			delete(this.commands, prefix)
+		}
+	}
+	return
+}
+
+func reportBufferedCommand(command bufferedCommand, desc string) {
+	ReportUndeliverableCommand(command.prefix, command.msg, UndeliverableNoSession, desc)
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestBuffer() *CommandBuffer {
+	return &CommandBuffer{disconnected: map[string]time.Time{}, commands: map[string][]bufferedCommand{}}
+}
+
+func TestCommandBufferAdd(t *testing.T) {
+	buffer := newTestBuffer()
+	if buffered, _ := buffer.Add("device", "c0"); buffered {
+		t.Fatal("commands of devices that are not recently disconnected must not be buffered")
+	}
+	buffer.Disconnected("device")
+	for _, msg := range []string{"c1", "c2"} {
+		if buffered, dropped := buffer.Add("device", msg); !buffered || len(dropped) != 0 {
+			t.Fatal("command not buffered", msg, dropped)
+		}
+	}
+	//config.CommandBufferSize is 2
+	buffered, dropped := buffer.Add("device", "c3")
+	if !buffered || len(dropped) != 1 || dropped[0].msg != "c1" {
+		t.Fatal("oldest command not dropped on overflow", dropped)
+	}
+	if result := buffer.Take("device"); !reflect.DeepEqual(result, []string{"c2", "c3"}) {
+		t.Fatal("unexpected buffered commands", result)
+	}
+	if buffered, _ := buffer.Add("device", "c4"); buffered {
+		t.Fatal("Take() must end the buffering of the device")
+	}
+}
+
+func TestCommandBufferExpire(t *testing.T) {
+	buffer := newTestBuffer()
+	now := time.Now()
+	buffer.Disconnected("expired")
+	buffer.Add("expired", "c1")
+	buffer.disconnected["expired"] = now.Add(-buffer.ttl() - time.Second)
+	buffer.Disconnected("recent")
+	buffer.Add("recent", "c2")
+	buffer.Add("recent", "c3")
+	buffer.commands["recent"][0].received = now.Add(-buffer.ttl() - time.Second)
+
+	expired, released := buffer.expire(now)
+
+	if !reflect.DeepEqual(released, []string{"expired"}) {
+		t.Fatal("unexpected released prefixes", released)
+	}
+	msgs := map[string]bool{}
+	for _, command := range expired {
+		msgs[command.msg] = true
+	}
+	if !reflect.DeepEqual(msgs, map[string]bool{"c1": true, "c2": true}) {
+		t.Fatal("unexpected expired commands", expired)
+	}
+	if result := buffer.Take("recent"); !reflect.DeepEqual(result, []string{"c3"}) {
+		t.Fatal("unexpected remaining commands", result)
+	}
+}
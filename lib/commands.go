@@ -0,0 +1,134 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var metricCommandTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "connector_command_timeouts_total",
+	Help: "Number of commands without response from the gateway within config.CommandTimeout.",
+})
+
+func init() {
+	prometheus.MustRegister(metricCommandTimeouts)
+}
+
+type pendingCommand struct {
+	command  map[string]interface{}
+	prefix   string
+	deadline time.Time
+}
+
+// tracks commands sent to gateways until their response arrives or config.CommandTimeout is reached
+type CommandTracker struct {
+	mux     sync.Mutex
+	pending map[string]pendingCommand
+}
+
+var commandTracker *CommandTracker
+var onceCommandTracker sync.Once
+
+func Commands() *CommandTracker {
+	onceCommandTracker.Do(func() {
+		commandTracker = &CommandTracker{pending: map[string]pendingCommand{}}
+		if util.Config.CommandTimeout > 0 {
+			go commandTracker.expireLoop()
+		}
+	})
+	return commandTracker
+}
+
+func CommandCorrelationId(command map[string]interface{}) string {
+	id, _ := command[util.Config.CommandCorrelationField].(string)
+	return id
+}
+
+func (this *CommandTracker) Track(prefix string, command map[string]interface{}) {
+	id := CommandCorrelationId(command)
+	if util.Config.CommandTimeout <= 0 || id == "" {
+		return
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.pending[id] = pendingCommand{
+		command:  command,
+		prefix:   prefix,
+		deadline: time.Now().Add(time.Duration(util.Config.CommandTimeout) * time.Second),
+	}
+}
+
+// returns false if the command is unknown or already expired
+func (this *CommandTracker) Resolve(id string) bool {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	_, ok := this.pending[id]
+	delete(this.pending, id)
+	return ok
+}
+
+func (this *CommandTracker) Pending() int {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return len(this.pending)
+}
+
+func (this *CommandTracker) expireLoop() {
+	ticker := time.NewTicker(time.Second)
+	for now := range ticker.C {
+		expired := []pendingCommand{}
+		this.mux.Lock()
+		for id, pending := range this.pending {
+			if now.After(pending.deadline) {
+				expired = append(expired, pending)
+				delete(this.pending, id)
+			}
+		}
+		this.mux.Unlock()
+		for _, pending := range expired {
+			log.Println("WARNING: command timeout", pending.prefix, CommandCorrelationId(pending.command))
+			metricCommandTimeouts.Inc()
+			err := PublishCommandError(pending.command, "timeout")
+			if err != nil {
+				log.Println("ERROR: unable to publish command timeout", err)
+			}
+		}
+	}
+}
+
+// publishes a synthetic response to config.KafkaResponseTopic; the command is returned with an error protocol part
+func PublishCommandError(command map[string]interface{}, reason string) error {
+	response := map[string]interface{}{}
+	for key, value := range command {
+		response[key] = value
+	}
+	response["protocol_parts"] = []map[string]string{{"name": "error", "value": reason}}
+	msg, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	key, _ := command["device_instance_id"].(string)
+	return Produce(util.Config.KafkaResponseTopic, key, string(msg))
+}
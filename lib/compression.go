@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var metricWsRawBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "connector_ws_raw_bytes_total",
+	Help: "Uncompressed size of websocket message payloads by direction.",
+}, []string{"direction"})
+
+var metricWsWireBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "connector_ws_wire_bytes_total",
+	Help: "Bytes sent and received on websocket connections including framing and compression, by direction.",
+}, []string{"direction"})
+
+func init() {
+	prometheus.MustRegister(metricWsRawBytes, metricWsWireBytes)
+}
+
+func WsCompressionEnabled() bool {
+	return util.Config.WsCompression == "true"
+}
+
+// applies config.WsCompressionLevel to a new connection; has no effect if permessage-deflate was not negotiated
+func configureCompression(connection *websocket.Conn) error {
+	if !WsCompressionEnabled() || util.Config.WsCompressionLevel == 0 {
+		return nil
+	}
+	return connection.SetCompressionLevel(int(util.Config.WsCompressionLevel))
+}
+
+// messages smaller than config.WsCompressionThreshold are sent uncompressed
+func compressMessage(data []byte) bool {
+	return WsCompressionEnabled() && int64(len(data)) >= util.Config.WsCompressionThreshold
+}
+
+type TrafficStats struct {
+	RawIn   int64 `json:"raw_in"`
+	RawOut  int64 `json:"raw_out"`
+	WireIn  int64 `json:"wire_in"`
+	WireOut int64 `json:"wire_out"`
+}
+
+type trafficCounter struct {
+	rawIn   int64
+	rawOut  int64
+	wireIn  int64
+	wireOut int64
+}
+
+func (this *trafficCounter) addRawIn(n int) {
+	atomic.AddInt64(&this.rawIn, int64(n))
+	metricWsRawBytes.WithLabelValues("in").Add(float64(n))
+}
+
+func (this *trafficCounter) addRawOut(n int) {
+	atomic.AddInt64(&this.rawOut, int64(n))
+	metricWsRawBytes.WithLabelValues("out").Add(float64(n))
+}
+
+func (this *trafficCounter) Stats() TrafficStats {
+	return TrafficStats{
+		RawIn:   atomic.LoadInt64(&this.rawIn),
+		RawOut:  atomic.LoadInt64(&this.rawOut),
+		WireIn:  atomic.LoadInt64(&this.wireIn),
+		WireOut: atomic.LoadInt64(&this.wireOut),
+	}
+}
+
+// counts the bytes read from and written to the hijacked connection
+type countingConn struct {
+	net.Conn
+	counter *trafficCounter
+}
+
+func (this countingConn) Read(b []byte) (n int, err error) {
+	n, err = this.Conn.Read(b)
+	atomic.AddInt64(&this.counter.wireIn, int64(n))
+	metricWsWireBytes.WithLabelValues("in").Add(float64(n))
+	return
+}
+
+func (this countingConn) Write(b []byte) (n int, err error) {
+	n, err = this.Conn.Write(b)
+	atomic.AddInt64(&this.counter.wireOut, int64(n))
+	metricWsWireBytes.WithLabelValues("out").Add(float64(n))
+	return
+}
+
+// wraps the connection returned by Hijack() in a countingConn
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (this countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := this.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	counting := countingConn{Conn: conn, counter: &trafficCounter{}}
+	if rw.Reader.Buffered() == 0 {
+		//the websocket library may reuse the buffered reader, which would bypass the counter
+		rw.Reader.Reset(counting)
+	}
+	return counting, rw, nil
+}
+
+// returns the counter of a connection upgraded with a countingResponseWriter
+func connectionTraffic(connection *websocket.Conn) *trafficCounter {
+	if conn, ok := connection.UnderlyingConn().(countingConn); ok {
+		return conn.counter
+	}
+	return &trafficCounter{}
+}
@@ -23,31 +23,20 @@ import (
 	"time"
 
 	"encoding/json"
-
-	"github.com/wvanbergen/kafka/consumergroup"
-	kazoo "github.com/wvanbergen/kazoo-go"
 )
 
+// the producer is closed by Shutdown()
 func InitConsumer() {
-	defer CloseProducer()
-	Produce(util.Config.KafkaConsumerTopic, "topic_init")
-
-	zk, chroot := kazoo.ParseConnectionString(util.Config.ZookeeperUrl)
-	kafkaconf := consumergroup.NewConfig()
-	kafkaconf.Consumer.Return.Errors = util.Config.FatalKafkaErrors == "true"
-	kafkaconf.Zookeeper.Chroot = chroot
-	consumerGroupName := util.Config.KafkaConsumerTopic
-	consumer, err := consumergroup.JoinConsumerGroup(
-		consumerGroupName,
-		[]string{util.Config.KafkaConsumerTopic},
-		zk,
-		kafkaconf)
-
+	err := Produce(util.Config.KafkaConsumerTopic, "", "topic_init")
 	if err != nil {
-		log.Fatal("error in consumergroup.JoinConsumerGroup()", err)
+		log.Fatal("error while initializing consumer topic", err)
 	}
 
-	defer consumer.Close()
+	messages, errors, err := Bus().Subscribe(util.Config.KafkaConsumerTopic)
+	if err != nil {
+		log.Fatal("error in Bus().Subscribe()", err)
+	}
+	markConsumerSubscribed()
 
 	kafkaTimeout := util.Config.KafkaTimeout
 	useTimeout := true
@@ -64,24 +53,35 @@ func InitConsumer() {
 		select {
 		case <-kafkaping.C:
 			if useTimeout && timeout {
-				Produce(util.Config.KafkaConsumerTopic, "topic_init")
+				if err := Produce(util.Config.KafkaConsumerTopic, "", "topic_init"); err != nil {
+					log.Println("ERROR: unable to send kafka ping", err)
+				}
 			}
 		case <-kafkatimout.C:
 			if useTimeout && timeout {
 				log.Fatal("ERROR: kafka missing ping timeout")
 			}
 			timeout = true
-		case errMsg := <-consumer.Errors():
+		case errMsg := <-errors:
 			log.Fatal("kafka consumer error: ", errMsg)
-		case msg, ok := <-consumer.Messages():
+		case msg, ok := <-messages:
+			if !ok && ShuttingDown() {
+				log.Println("kafka consumer closed")
+				return
+			}
 			if !ok {
 				log.Fatal("empty kafka consumer")
 			} else {
+				metricKafkaConsumed.Inc()
+				markConsumerMessage()
 				if string(msg.Value) != "topic_init" {
 					HandleMessage(string(msg.Value))
 				}
 				timeout = false
-				consumer.CommitUpto(msg)
+				err = Bus().Commit(msg)
+				if err != nil {
+					log.Println("ERROR: unable to commit consumed message", err)
+				}
 			}
 		}
 	}
@@ -99,11 +99,13 @@ func HandleMessage(msg string) {
 	err := json.Unmarshal([]byte(msg), &envelope)
 	if err != nil {
 		log.Println("ERROR: ", err)
+		ReportUndeliverableCommand("", msg, UndeliverableParseError, err.Error())
 		return
 	}
 	payload, err := json.Marshal(envelope.Value)
 	if err != nil {
 		log.Println("ERROR: ", err)
+		ReportUndeliverableCommand(envelope.DeviceId, msg, UndeliverableParseError, err.Error())
 		return
 	}
 	Sessions().Dispatch(envelope.DeviceId, string(payload))
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+// remembers client message ids per device for config.EventDedupWindow seconds
+type EventDeduplicator struct {
+	mux  sync.Mutex
+	seen map[string]map[string]time.Time //device id -> message id -> claim time
+}
+
+var eventDeduplicator *EventDeduplicator
+var onceEventDeduplicator sync.Once
+
+func Dedup() *EventDeduplicator {
+	onceEventDeduplicator.Do(func() {
+		eventDeduplicator = &EventDeduplicator{seen: map[string]map[string]time.Time{}}
+		if util.Config.EventDedupWindow > 0 {
+			go eventDeduplicator.cleanupLoop()
+		}
+	})
+	return eventDeduplicator
+}
+
+func (this *EventDeduplicator) window() time.Duration {
+	return time.Duration(util.Config.EventDedupWindow) * time.Second
+}
+
+// returns false if the message id was already claimed for the device within the window
+func (this *EventDeduplicator) Claim(deviceId string, messageId string) bool {
+	if util.Config.EventDedupWindow <= 0 || messageId == "" {
+		return true
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	device, ok := this.seen[deviceId]
+	if !ok {
+		device = map[string]time.Time{}
+		this.seen[deviceId] = device
+	}
+	if claimed, ok := device[messageId]; ok && time.Since(claimed) <= this.window() {
+		return false
+	}
+	device[messageId] = time.Now()
+	return true
+}
+
+// forgets a claimed message id; used if the event could not be produced
+func (this *EventDeduplicator) Release(deviceId string, messageId string) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	delete(this.seen[deviceId], messageId)
+}
+
+func (this *EventDeduplicator) cleanupLoop() {
+	ticker := time.NewTicker(this.window())
+	for now := range ticker.C {
+		this.mux.Lock()
+		for deviceId, device := range this.seen {
+			for messageId, claimed := range device {
+				if now.Sub(claimed) > this.window() {
+					delete(device, messageId)
+				}
+			}
+			if len(device) == 0 {
+				delete(this.seen, deviceId)
+			}
+		}
+		this.mux.Unlock()
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+func TestDedupClaim(t *testing.T) {
+	dedup := &EventDeduplicator{seen: map[string]map[string]time.Time{}}
+	steps := []struct {
+		name      string
+		deviceId  string
+		messageId string
+		release   bool
+		expected  bool
+	}{
+		{name: "first claim", deviceId: "d1", messageId: "m1", expected: true},
+		{name: "duplicate", deviceId: "d1", messageId: "m1", expected: false},
+		{name: "same id of other device", deviceId: "d2", messageId: "m1", expected: true},
+		{name: "without message id", deviceId: "d1", messageId: "", expected: true},
+		{name: "without message id again", deviceId: "d1", messageId: "", expected: true},
+		{name: "release", deviceId: "d1", messageId: "m1", release: true},
+		{name: "claim after release", deviceId: "d1", messageId: "m1", expected: true},
+	}
+	for _, step := range steps {
+		if step.release {
+			dedup.Release(step.deviceId, step.messageId)
+			continue
+		}
+		if result := dedup.Claim(step.deviceId, step.messageId); result != step.expected {
+			t.Fatal(step.name, "unexpected claim result", result)
+		}
+	}
+}
+
+func TestDedupDisabled(t *testing.T) {
+	withConfig(t, func(config *util.ConfigStruct) {
+		config.EventDedupWindow = 0
+	})
+	dedup := &EventDeduplicator{seen: map[string]map[string]time.Time{}}
+	if !dedup.Claim("d1", "m1") || !dedup.Claim("d1", "m1") {
+		t.Fatal("message ids must not be deduplicated if EventDedupWindow is 0")
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	dedup := &EventDeduplicator{seen: map[string]map[string]time.Time{}}
+	dedup.Claim("d1", "m1")
+	dedup.seen["d1"]["m1"] = time.Now().Add(-dedup.window() - time.Second)
+	if !dedup.Claim("d1", "m1") {
+		t.Fatal("message id must be claimable after the window")
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/Shopify/sarama"
+)
+
+var deliverySuccesses int64
+var deliveryErrors int64
+var deliveryDeadLetters int64
+
+var deadLetterFileMux sync.Mutex
+
+type DeliveryStats struct {
+	Successes   int64 `json:"successes"`
+	Errors      int64 `json:"errors"`
+	DeadLetters int64 `json:"dead_letters"`
+}
+
+type DeadLetter struct {
+	Topic string    `json:"topic"`
+	Key   string    `json:"key,omitempty"`
+	Value string    `json:"value"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// attached to every produced message to route its delivery report
+type deliveryMetadata struct {
+	result     chan error //only set in sync ack mode
+	deadLetter bool
+}
+
+func GetDeliveryStats() DeliveryStats {
+	return DeliveryStats{
+		Successes:   atomic.LoadInt64(&deliverySuccesses),
+		Errors:      atomic.LoadInt64(&deliveryErrors),
+		DeadLetters: atomic.LoadInt64(&deliveryDeadLetters),
+	}
+}
+
+func SyncAck() bool {
+	return util.Config.KafkaSyncAck == "true"
+}
+
+// drains the successes and errors of the producer until both channels are closed
+func HandleDeliveryReports(producer sarama.AsyncProducer) {
+	successes := producer.Successes()
+	errs := producer.Errors()
+	for successes != nil || errs != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			atomic.AddInt64(&deliverySuccesses, 1)
+			markDelivery(nil)
+			notifyDelivery(msg, nil)
+		case producerErr, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			atomic.AddInt64(&deliveryErrors, 1)
+			markDelivery(producerErr.Err)
+			log.Println("ERROR: kafka delivery failed", producerErr.Msg.Topic, producerErr.Err)
+			meta, _ := producerErr.Msg.Metadata.(*deliveryMetadata)
+			if meta == nil || !meta.deadLetter {
+				handleDeadLetter(producer, producerErr)
+			}
+			notifyDelivery(producerErr.Msg, producerErr.Err)
+		}
+	}
+	log.Println("delivery report handler stopped", GetDeliveryStats())
+}
+
+func notifyDelivery(msg *sarama.ProducerMessage, err error) {
+	meta, ok := msg.Metadata.(*deliveryMetadata)
+	if ok && meta.result != nil {
+		meta.result <- err
+	}
+}
+
+func WaitForDelivery(result chan error) error {
+	timeout := util.Config.KafkaSyncAckTimeout
+	if timeout <= 0 {
+		return <-result
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(time.Duration(timeout) * time.Second):
+		return errors.New("timeout while waiting for kafka delivery report")
+	}
+}
+
+func handleDeadLetter(producer sarama.AsyncProducer, producerErr *sarama.ProducerError) {
+	if util.Config.KafkaDeadLetterTopic == "" && util.Config.KafkaDeadLetterFile == "" {
+		return
+	}
+	letter := DeadLetter{Topic: producerErr.Msg.Topic, Error: producerErr.Err.Error(), Time: time.Now()}
+	if producerErr.Msg.Key != nil {
+		key, _ := producerErr.Msg.Key.Encode()
+		letter.Key = string(key)
+	}
+	if producerErr.Msg.Value != nil {
+		value, _ := producerErr.Msg.Value.Encode()
+		letter.Value = string(value)
+	}
+	msg, err := json.Marshal(letter)
+	if err != nil {
+		log.Println("ERROR: unable to marshal dead letter", err)
+		return
+	}
+	atomic.AddInt64(&deliveryDeadLetters, 1)
+	if util.Config.KafkaDeadLetterFile != "" {
+		err = writeDeadLetterFile(msg)
+		if err != nil {
+			log.Println("ERROR: unable to write dead letter file", util.Config.KafkaDeadLetterFile, err, string(msg))
+		}
+	}
+	if util.Config.KafkaDeadLetterTopic != "" {
+		//async to prevent a deadlock between the producer input and this report handler
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Println("ERROR: unable to produce dead letter; producer is closed", string(msg))
+				}
+			}()
+			producer.Input() <- &sarama.ProducerMessage{
+				Topic:     util.Config.KafkaDeadLetterTopic,
+				Value:     sarama.ByteEncoder(msg),
+				Timestamp: time.Now(),
+				Metadata:  &deliveryMetadata{deadLetter: true},
+			}
+		}()
+	}
+}
+
+func writeDeadLetterFile(msg []byte) error {
+	deadLetterFileMux.Lock()
+	defer deadLetterFileMux.Unlock()
+	file, err := os.OpenFile(util.Config.KafkaDeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(msg, '\n'))
+	return err
+}
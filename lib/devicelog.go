@@ -36,8 +36,7 @@ func LogDeviceState(id string, state string, desc string) (err error) {
 	if err != nil {
 		return err
 	}
-	Produce(util.Config.KafkaDeviceLogTopic, string(msg))
-	return
+	return Produce(util.Config.KafkaDeviceLogTopic, id, string(msg))
 }
 
 func (session *Session) LogDisconnect() {
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/streadway/amqp"
+)
+
+var consumerSubscribed int32
+var consumerLastMessage int64 //unix nano
+var lastDeliverySuccess int64 //unix nano
+var lastDeliveryError int64   //unix nano
+
+type HealthCheck struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Ok     bool                   `json:"ok"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+type healthCheckFunction func() error
+
+func markConsumerSubscribed() {
+	atomic.StoreInt64(&consumerLastMessage, time.Now().UnixNano())
+	atomic.StoreInt32(&consumerSubscribed, 1)
+}
+
+func markConsumerMessage() {
+	atomic.StoreInt64(&consumerLastMessage, time.Now().UnixNano())
+}
+
+func markDelivery(err error) {
+	if err == nil {
+		atomic.StoreInt64(&lastDeliverySuccess, time.Now().UnixNano())
+	} else {
+		atomic.StoreInt64(&lastDeliveryError, time.Now().UnixNano())
+	}
+}
+
+// liveness: checks only the state of this process; failing dependencies must not restart the connector
+func livenessChecks() map[string]healthCheckFunction {
+	return map[string]healthCheckFunction{
+		"sessions": checkSessionsLock,
+	}
+}
+
+// readiness: checks the dependencies needed to serve gateways
+func readinessChecks() map[string]healthCheckFunction {
+	checks := livenessChecks()
+	checks["shutdown"] = func() error {
+		if ShuttingDown() {
+			return errors.New(shutdownCloseReason)
+		}
+		return nil
+	}
+	checks["kafka_producer"] = checkProducer
+	checks["kafka_consumer"] = checkConsumer
+	checks["amqp"] = checkAmqp
+	checks["pts"] = func() error { return checkReachable(util.Config.PtsUrl) }
+	checks["iot_repository"] = func() error { return checkReachable(util.Config.IotRepoUrl) }
+	checks["auth"] = func() error { return checkReachable(util.Config.AuthEndpoint) }
+	if MqttEnabled() {
+		checks["mqtt"] = checkMqtt
+	}
+	return checks
+}
+
+// detects a dead lock of the sessions collection used by every dispatch and handshake
+func checkSessionsLock() error {
+	done := make(chan bool, 1)
+	go func() {
+		Sessions().Count()
+		done <- true
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(healthCheckTimeout()):
+		return errors.New("sessions collection is locked")
+	}
+}
+
+func checkProducer() error {
+	lastError := atomic.LoadInt64(&lastDeliveryError)
+	if lastError != 0 && lastError > atomic.LoadInt64(&lastDeliverySuccess) {
+		return errors.New("last kafka delivery failed at " + time.Unix(0, lastError).String())
+	}
+	return nil
+}
+
+func checkConsumer() error {
+	if atomic.LoadInt32(&consumerSubscribed) == 0 {
+		return errors.New("consumer not subscribed")
+	}
+	if util.Config.KafkaTimeout <= 0 {
+		return nil
+	}
+	since := time.Since(time.Unix(0, atomic.LoadInt64(&consumerLastMessage)))
+	if since > 2*time.Duration(util.Config.KafkaTimeout)*time.Second {
+		return errors.New("kafka ping loop stalled; last message consumed " + since.String() + " ago")
+	}
+	return nil
+}
+
+var amqpProbe chan bool
+var amqpProbeMux sync.Mutex
+
+func checkAmqp() error {
+	if conn == nil {
+		return errors.New("amqp connection not initialized")
+	}
+	//UseChannel blocks while the connection is reconnecting; at most one probe waits for it
+	amqpProbeMux.Lock()
+	probe := amqpProbe
+	if probe == nil {
+		probe = make(chan bool)
+		amqpProbe = probe
+		go func() {
+			conn.UseChannel(func(channel *amqp.Channel) {})
+			amqpProbeMux.Lock()
+			amqpProbe = nil
+			amqpProbeMux.Unlock()
+			close(probe)
+		}()
+	}
+	amqpProbeMux.Unlock()
+	select {
+	case <-probe:
+		return nil
+	case <-time.After(healthCheckTimeout()):
+		return errors.New("amqp connection is not available")
+	}
+}
+
+func checkReachable(url string) error {
+	client := http.Client{Timeout: healthCheckTimeout()}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return errors.New("unexpected status code " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+func healthCheckTimeout() time.Duration {
+	if util.Config.HealthCheckTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(util.Config.HealthCheckTimeout) * time.Second
+}
+
+func runHealthChecks(checks map[string]healthCheckFunction) (report HealthReport) {
+	report = HealthReport{Ok: true, Checks: map[string]HealthCheck{}}
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check healthCheckFunction) {
+			defer wg.Done()
+			result := HealthCheck{Ok: true}
+			if err := check(); err != nil {
+				result = HealthCheck{Ok: false, Error: err.Error()}
+			}
+			mux.Lock()
+			report.Checks[name] = result
+			report.Ok = report.Ok && result.Ok
+			mux.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	return
+}
+
+func healthHandler(checks func() map[string]healthCheckFunction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := runHealthChecks(checks())
+		if !report.Ok {
+			log.Println("WARNING: health check failed", r.URL.Path, report)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if report.Ok {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
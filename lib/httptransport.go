@@ -0,0 +1,419 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/gorilla/websocket"
+)
+
+const httpTransportBufferSize = 16
+
+// delivered messages are kept until acknowledged by the gateway
+type httpMessage struct {
+	id  uint64
+	msg outboundMessage
+}
+
+// delivers the outbound messages of a session to long-poll or server-sent-events requests of the gateway
+type httpTransport struct {
+	session   *Session
+	messages  chan outboundMessage
+	closed    chan bool
+	closeOnce sync.Once
+	reason    string
+	polling   int32
+	lastPoll  int64 //unix nano
+	traffic   *trafficCounter
+	secret    [sha256.Size]byte //hash of the session secret; the session id alone does not authorize requests
+	mux       sync.Mutex
+	lastId    uint64
+	unacked   []httpMessage //delivered but not acknowledged; at most httpTransportBufferSize
+}
+
+func HttpTransportEnabled() bool {
+	return util.Config.HttpTransport == "true"
+}
+
+func httpPollWait() time.Duration {
+	if util.Config.HttpPollWait > 0 {
+		return time.Duration(util.Config.HttpPollWait) * time.Second
+	}
+	return 30 * time.Second
+}
+
+func httpSessionTimeout() time.Duration {
+	if util.Config.HttpSessionTimeout > 0 {
+		return time.Duration(util.Config.HttpSessionTimeout) * time.Second
+	}
+	return time.Duration(util.Config.WsTimeout) * time.Second
+}
+
+func httpMaxBodySize() int64 {
+	if util.Config.HttpMaxBodySize > 0 {
+		return util.Config.HttpMaxBodySize
+	}
+	return 1 << 20
+}
+
+// limits the request body to httpMaxBodySize()
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	return ioutil.ReadAll(http.MaxBytesReader(w, r.Body, httpMaxBodySize()))
+}
+
+// returns the transport and the session secret handed to the gateway
+func newHttpTransport() (transport *httpTransport, secret string, err error) {
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return nil, "", err
+	}
+	secret = hex.EncodeToString(random)
+	transport = &httpTransport{
+		messages: make(chan outboundMessage, httpTransportBufferSize),
+		closed:   make(chan bool),
+		lastPoll: time.Now().UnixNano(),
+		traffic:  &trafficCounter{},
+		secret:   sha256.Sum256([]byte(secret)),
+	}
+	return transport, secret, nil
+}
+
+// expects "Authorization: Bearer <<session_secret>>"
+func (this *httpTransport) authorized(r *http.Request) bool {
+	hash := sha256.Sum256([]byte(bearerToken(r)))
+	return subtle.ConstantTimeCompare(hash[:], this.secret[:]) == 1
+}
+
+func (this *httpTransport) Name() string {
+	return "http"
+}
+
+// blocks until the gateway polls; the outbound queue of the session applies its overflow policy meanwhile
+func (this *httpTransport) Write(msg outboundMessage) error {
+	if msg.msgType == websocket.CloseMessage {
+		return this.WriteControl(msg.msgType, msg.data)
+	}
+	select {
+	case this.messages <- msg:
+		return nil
+	case <-this.closed:
+		return websocket.ErrCloseSent
+	case <-time.After(httpSessionTimeout()):
+		return errors.New("gateway does not poll")
+	}
+}
+
+func (this *httpTransport) WriteControl(msgType int, data []byte) error {
+	if msgType != websocket.CloseMessage {
+		return nil
+	}
+	reason := ""
+	if len(data) > 2 {
+		reason = string(data[2:]) //skip close code
+	}
+	this.closeStream(reason)
+	return nil
+}
+
+func (this *httpTransport) closeStream(reason string) {
+	this.closeOnce.Do(func() {
+		this.reason = reason
+		close(this.closed)
+	})
+}
+
+func (this *httpTransport) Close() error {
+	this.closeStream("session closed")
+	return nil
+}
+
+func (this *httpTransport) Traffic() *trafficCounter {
+	return this.traffic
+}
+
+func (this *httpTransport) startPoll() {
+	atomic.AddInt32(&this.polling, 1)
+}
+
+func (this *httpTransport) endPoll() {
+	atomic.StoreInt64(&this.lastPoll, time.Now().UnixNano())
+	atomic.AddInt32(&this.polling, -1)
+}
+
+// closes the session if the gateway did not poll within httpSessionTimeout()
+func (this *httpTransport) watchdog() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.closed:
+			return
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&this.lastPoll)))
+			if atomic.LoadInt32(&this.polling) == 0 && idle > httpSessionTimeout() {
+				this.session.Close("poll timeout")
+				return
+			}
+		}
+	}
+}
+
+// ends all polls and streams of http sessions so that the server can shut down
+func closeHttpStreams() {
+	for _, session := range Sessions().List() {
+		if transport, ok := session.transport.(*httpTransport); ok {
+			transport.closeStream(shutdownCloseReason)
+		}
+	}
+}
+
+// POST   /sessions                handshake; responds with the session id and the session secret
+// all other requests need the header "Authorization: Bearer <<session_secret>>"
+// GET    /sessions/{id}/messages  long-poll or server-sent-events (Accept: text/event-stream) of outbound messages
+// POST   /sessions/{id}/messages  request envelope of any handler, e.g. response to a command
+// DELETE /sessions/{id}
+func httpSessionHandler(w http.ResponseWriter, r *http.Request) {
+	parts, err := pathParts(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(parts) == 1 && parts[0] == "sessions" && r.Method == http.MethodPost {
+		httpHandshake(w, r)
+		return
+	}
+	if len(parts) < 2 || parts[0] != "sessions" {
+		http.NotFound(w, r)
+		return
+	}
+	session, ok := Sessions().Get(parts[1])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	transport, ok := session.transport.(*httpTransport)
+	if !ok || !transport.authorized(r) {
+		//same response as for unknown sessions to not reveal session ids
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 3 && parts[2] == "messages" && r.Method == http.MethodGet:
+		if r.Header.Get("Accept") == "text/event-stream" {
+			transport.stream(w, r)
+		} else {
+			transport.poll(w, r)
+		}
+	case len(parts) == 3 && parts[2] == "messages" && r.Method == http.MethodPost:
+		if ShuttingDown() {
+			http.Error(w, shutdownCloseReason, http.StatusServiceUnavailable)
+			return
+		}
+		body, err := readBody(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		transport.traffic.addRawIn(len(body))
+		session.HandleMessage(body)
+		w.WriteHeader(http.StatusAccepted)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		session.Close("closed by gateway")
+		writeJson(w, "ok")
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// the body is the same handshake as on the websocket; the handshake response is the first message of the session
+func httpHandshake(w http.ResponseWriter, r *http.Request) {
+	if ShuttingDown() {
+		http.Error(w, shutdownCloseReason, http.StatusServiceUnavailable)
+		return
+	}
+	body, err := readBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cred, handshake, err := ParseHandshake(body, JsonCodec, transportAuth(r))
+	if err != nil {
+		log.Println("http handshake error", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	transport, secret, err := newHttpTransport()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	session, err := OpenSession(transport, cred, handshake, JsonCodec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	transport.session = session
+	go transport.watchdog()
+	writeJson(w, map[string]string{"session_id": session.Id, "session_secret": secret})
+}
+
+// removes the messages acknowledged with the header "Last-Event-ID: <<id>>" or the query parameter ack
+func (this *httpTransport) acknowledge(r *http.Request) {
+	ack := r.Header.Get("Last-Event-ID")
+	if ack == "" {
+		ack = r.URL.Query().Get("ack")
+	}
+	if ack == "" {
+		return
+	}
+	id, err := strconv.ParseUint(ack, 10, 64)
+	if err != nil {
+		return
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	remaining := []httpMessage{}
+	for _, msg := range this.unacked {
+		if msg.id > id {
+			remaining = append(remaining, msg)
+		}
+	}
+	this.unacked = remaining
+}
+
+// returns a copy of the delivered but not acknowledged messages
+func (this *httpTransport) pending() []httpMessage {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return append([]httpMessage{}, this.unacked...)
+}
+
+// assigns the next id to the message and keeps it until acknowledged;
+// if evict is set the oldest unacknowledged message is dropped instead of exceeding httpTransportBufferSize
+func (this *httpTransport) deliver(msg outboundMessage, evict bool) httpMessage {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.lastId++
+	result := httpMessage{id: this.lastId, msg: msg}
+	this.unacked = append(this.unacked, result)
+	if evict && len(this.unacked) > httpTransportBufferSize {
+		this.unacked = this.unacked[len(this.unacked)-httpTransportBufferSize:]
+	}
+	return result
+}
+
+func (this *httpTransport) full() bool {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return len(this.unacked) >= httpTransportBufferSize
+}
+
+// responds with all unacknowledged messages; if there are none, waits up to httpPollWait() for new messages.
+// messages are repeated until the gateway acknowledges them with the id of the response header X-Last-Message-Id
+func (this *httpTransport) poll(w http.ResponseWriter, r *http.Request) {
+	this.startPoll()
+	defer this.endPoll()
+	this.acknowledge(r)
+	if len(this.pending()) == 0 {
+		select {
+		case msg := <-this.messages:
+			this.deliver(msg, false)
+		case <-this.closed:
+			http.Error(w, this.reason, http.StatusGone)
+			return
+		case <-r.Context().Done():
+			return
+		case <-time.After(httpPollWait()):
+		}
+	}
+	for more := true; more && !this.full(); {
+		select {
+		case msg := <-this.messages:
+			this.deliver(msg, false)
+		default:
+			more = false
+		}
+	}
+	msgs := [][]byte{}
+	var lastId uint64
+	for _, msg := range this.pending() {
+		msgs = append(msgs, msg.msg.data)
+		lastId = msg.id
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if lastId > 0 {
+		w.Header().Set("X-Last-Message-Id", strconv.FormatUint(lastId, 10))
+	}
+	w.Write([]byte("[" + string(bytes.Join(msgs, []byte(","))) + "]"))
+}
+
+// sends every message as event named by its handler; a disconnect event ends the stream.
+// a reconnecting stream repeats the messages after its header Last-Event-ID (up to httpTransportBufferSize)
+func (this *httpTransport) stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	this.startPoll()
+	defer this.endPoll()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	this.acknowledge(r)
+	for _, msg := range this.pending() {
+		writeEvent(w, msg)
+	}
+	flusher.Flush()
+	keepalive := time.NewTicker(time.Duration(util.Config.WsPingperiod) * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg := <-this.messages:
+			writeEvent(w, this.deliver(msg, true))
+		case <-this.closed:
+			w.Write([]byte("event: disconnect\ndata: " + strconv.Quote(this.reason) + "\n\n"))
+			flusher.Flush()
+			return
+		case <-keepalive.C:
+			w.Write([]byte(": keepalive\n\n"))
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, msg httpMessage) {
+	w.Write([]byte("id: " + strconv.FormatUint(msg.id, 10) + "\nevent: " + msg.msg.handler + "\ndata: " + string(msg.msg.data) + "\n\n"))
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testHttpSession(t *testing.T) (*Session, *httpTransport, string) {
+	transport, secret, err := newHttpTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := testSession()
+	session.transport = transport
+	session.traffic = transport.Traffic()
+	session.closing = true //Close() needs the connection log
+	transport.session = session
+	go session.writeLoop()
+	t.Cleanup(func() {
+		session.closeOutbox()
+		<-session.writerDone
+	})
+	return session, transport, secret
+}
+
+// waits until the writer of the session handed all queued messages to the transport
+func waitForWriter(t *testing.T, session *Session, transport *httpTransport, queued int) {
+	deadline := time.Now().Add(time.Second)
+	for session.QueueDepth() > 0 || len(transport.messages) < queued {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout while waiting for writer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func poll(t *testing.T, transport *httpTransport, query string) (payloads []string, lastId string) {
+	recorder := httptest.NewRecorder()
+	transport.poll(recorder, httptest.NewRequest(http.MethodGet, "/sessions/id/messages"+query, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatal("unexpected status", recorder.Code, recorder.Body.String())
+	}
+	msgs := []Message{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &msgs); err != nil {
+		t.Fatal(err, recorder.Body.String())
+	}
+	for _, msg := range msgs {
+		payloads = append(payloads, msg.Payload.(string))
+	}
+	return payloads, recorder.Header().Get("X-Last-Message-Id")
+}
+
+func TestHttpSessionAuthorization(t *testing.T) {
+	_, transport, secret := testHttpSession(t)
+	cases := []struct {
+		header     string
+		authorized bool
+	}{
+		{header: "Bearer " + secret, authorized: true},
+		{header: "Bearer " + secret + "0", authorized: false},
+		{header: "", authorized: false},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodGet, "/sessions/id/messages", nil)
+		if c.header != "" {
+			request.Header.Set("Authorization", c.header)
+		}
+		if transport.authorized(request) != c.authorized {
+			t.Fatal("unexpected authorization result for", c.header)
+		}
+	}
+}
+
+func TestHttpSessionPollRedelivery(t *testing.T) {
+	session, transport, _ := testHttpSession(t)
+	session.SendResponse(Message{Handler: "response", Payload: "first"})
+	session.SendResponse(Message{Handler: "response", Payload: "second"})
+	waitForWriter(t, session, transport, 2)
+
+	payloads, lastId := poll(t, transport, "")
+	if strings.Join(payloads, ",") != "first,second" || lastId != "2" {
+		t.Fatal("unexpected poll result", payloads, lastId)
+	}
+
+	//not acknowledged messages are repeated
+	session.SendResponse(Message{Handler: "response", Payload: "third"})
+	waitForWriter(t, session, transport, 1)
+	payloads, lastId = poll(t, transport, "")
+	if strings.Join(payloads, ",") != "first,second,third" || lastId != "3" {
+		t.Fatal("unexpected poll result", payloads, lastId)
+	}
+
+	session.SendResponse(Message{Handler: "response", Payload: "fourth"})
+	waitForWriter(t, session, transport, 1)
+	payloads, lastId = poll(t, transport, "?ack=2")
+	if strings.Join(payloads, ",") != "third,fourth" || lastId != "4" {
+		t.Fatal("unexpected poll result after ack", payloads, lastId)
+	}
+}
+
+func TestHttpSessionStreamReplay(t *testing.T) {
+	session, transport, _ := testHttpSession(t)
+	session.SendResponse(Message{Handler: "response", Payload: "first"})
+	session.SendResponse(Message{Handler: "response", Payload: "second"})
+	waitForWriter(t, session, transport, 2)
+	poll(t, transport, "")
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/sessions/id/messages", nil)
+	request.Header.Set("Last-Event-ID", "1")
+	transport.closeStream("closed by test")
+	transport.stream(recorder, request)
+
+	expected := "id: 2\nevent: response\n"
+	if body := recorder.Body.String(); !strings.HasPrefix(body, expected) || strings.Contains(body, "first") || !strings.Contains(body, "event: disconnect") {
+		t.Fatal("unexpected stream", body)
+	}
+}
@@ -33,6 +33,7 @@ import (
 )
 
 func GetGateway(id string, cred *Credentials) (gateway model.Gateway, err error) {
+	defer observeRepositoryCall("iot", "GetGateway", time.Now(), &err)
 	resp, err := cred.Get(util.Config.IotRepoUrl + "/gateway/" + url.QueryEscape(id) + "/provide")
 	if err != nil {
 		log.Println("ERROR on GetGateway()", err)
@@ -48,6 +49,7 @@ func GetGateway(id string, cred *Credentials) (gateway model.Gateway, err error)
 }
 
 func ClearGateway(id string, cred *Credentials) (err error) {
+	defer observeRepositoryCall("iot", "ClearGateway", time.Now(), &err)
 	var resp *http.Response
 	for i := 0; i < 30; i++ {
 		resp, err = cred.Post(util.Config.IotRepoUrl+"/gateway/"+url.QueryEscape(id)+"/clear", "application/json", nil)
@@ -68,6 +70,7 @@ func ClearGateway(id string, cred *Credentials) (err error) {
 }
 
 func CommitGateway(id string, gateway model.GatewayRef, cred *Credentials) (err error) {
+	defer observeRepositoryCall("iot", "CommitGateway", time.Now(), &err)
 	var resp *http.Response
 	for i := 0; i < 30; i++ {
 		b := new(bytes.Buffer)
@@ -92,6 +95,7 @@ func CommitGateway(id string, gateway model.GatewayRef, cred *Credentials) (err
 }
 
 func GetDeviceType(id string, cred *Credentials) (dt model.ShortDeviceType, err error) {
+	defer observeRepositoryCall("iot", "GetDeviceType", time.Now(), &err)
 	resp, err := cred.Get(util.Config.IotRepoUrl + "/deviceType/" + url.QueryEscape(id))
 	if err != nil {
 		log.Println("ERROR on GetDeviceType()", err)
@@ -123,6 +127,7 @@ func DeviceInstanceToDeviceServiceEntity(device iot_model.DeviceInstance, dtCach
 }
 
 func DeviceUrlToIotDevice(deviceUrl string, cred *Credentials) (entities []model.DeviceServiceEntity, err error) {
+	defer observeRepositoryCall("iot", "DeviceUrlToIotDevice", time.Now(), &err)
 	resp, err := cred.Get(util.Config.IotRepoUrl + "/url_to_devices/" + url.QueryEscape(deviceUrl))
 	if err != nil {
 		log.Println("error on ConnectorDeviceToIotDevice", err)
@@ -147,6 +152,7 @@ type IotErrorMessage struct {
 }
 
 func CreateIotDevice(device model.ConnectorDevice, cred *Credentials) (result iot_model.DeviceInstance, err error) {
+	defer observeRepositoryCall("iot", "CreateIotDevice", time.Now(), &err)
 	typeid := device.IotType
 
 	if typeid == "" {
@@ -217,6 +223,7 @@ func UpdateDevice(new model.ConnectorDevice, old model.DeviceServiceEntity, cred
 }
 
 func UpdateDeviceInstance(device iot_model.DeviceInstance, cred *Credentials) (err error) {
+	defer observeRepositoryCall("iot", "UpdateDeviceInstance", time.Now(), &err)
 	err = cred.EnsureAccess()
 	if err != nil {
 		return
@@ -267,6 +274,7 @@ func MergeTagIndexes(platform map[string]string, client map[string]string) (resu
 }
 
 func DeleteDeviceInstance(uri string, cred *Credentials) (err error) {
+	defer observeRepositoryCall("iot", "DeleteDeviceInstance", time.Now(), &err)
 	err = cred.EnsureAccess()
 	if err != nil {
 		return
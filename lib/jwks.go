@@ -0,0 +1,205 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const jwksMinRefreshInterval = time.Minute
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// public keys of an auth provider; reloaded if a token uses an unknown key id
+type KeySet struct {
+	url         string
+	mux         sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	lastRefresh time.Time
+}
+
+func NewKeySet(url string) *KeySet {
+	return &KeySet{url: url, keys: map[string]*rsa.PublicKey{}}
+}
+
+func (this *KeySet) Get(kid string) (key *rsa.PublicKey, err error) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	key, ok := this.keys[kid]
+	if ok {
+		return key, nil
+	}
+	if time.Since(this.lastRefresh) < jwksMinRefreshInterval {
+		return nil, errors.New("unknown key id '" + kid + "'")
+	}
+	err = this.refresh()
+	if err != nil {
+		return nil, err
+	}
+	key, ok = this.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown key id '" + kid + "'")
+	}
+	return key, nil
+}
+
+func (this *KeySet) refresh() (err error) {
+	defer observeRepositoryCall("auth", "jwks", time.Now(), &err)
+	this.lastRefresh = time.Now()
+	resp, err := authClient.Get(this.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected jwks response status " + resp.Status)
+	}
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := jwk.rsaPublicKey()
+		if err != nil {
+			return err
+		}
+		keys[jwk.Kid] = key
+	}
+	this.keys = keys
+	return nil
+}
+
+func (this jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(this.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(this.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+// config.AuthAudiences or config.AuthClientId
+func allowedAudiences() []string {
+	if len(util.Config.AuthAudiences) > 0 {
+		return util.Config.AuthAudiences
+	}
+	return []string{util.Config.AuthClientId}
+}
+
+// the token has to be issued for (azp) or to (aud) one of allowedAudiences()
+func verifyAudience(claims jwt.MapClaims) bool {
+	for _, audience := range allowedAudiences() {
+		if audience == "" {
+			continue
+		}
+		if azp, _ := claims["azp"].(string); azp == audience {
+			return true
+		}
+		if claims.VerifyAudience(audience, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// checks signature, expiration, issuer and audience of an access token of the realm
+func ValidateAccessToken(realm string, token string) (claims jwt.MapClaims, err error) {
+	provider, err := Provider(realm)
+	if err != nil {
+		return claims, err
+	}
+	claims = jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.New("unexpected signing method " + token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		return provider.keys.Get(kid)
+	})
+	if err != nil {
+		return claims, err
+	}
+	if !claims.VerifyIssuer(provider.Issuer, true) {
+		return claims, errors.New("unexpected token issuer")
+	}
+	if !verifyAudience(claims) {
+		return claims, errors.New("token not issued for this connector")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return claims, errors.New("token without expiration")
+	}
+	return claims, nil
+}
+
+// reads the claims of a token without validation; only for tokens received directly from the auth provider
+func unverifiedClaims(token string) (claims jwt.MapClaims, ok bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return claims, false
+	}
+	claims = jwt.MapClaims{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return claims, false
+	}
+	return claims, true
+}
+
+// reads the expiration of a token without validation; used for tokens that only the auth provider can verify
+func unverifiedExpiration(token string) (exp time.Time, ok bool) {
+	claims, ok := unverifiedClaims(token)
+	if !ok {
+		return exp, false
+	}
+	value, ok := claims["exp"].(float64)
+	if !ok {
+		return exp, false
+	}
+	return time.Unix(int64(value), 0), true
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeySetGet(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{
+			{
+				Kid: "sig",
+				Kty: "RSA",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(privateKey.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.E)).Bytes()),
+			},
+			{Kid: "enc", Kty: "RSA", Use: "enc", N: "AQAB", E: "AQAB"},
+			{Kid: "ec", Kty: "EC"},
+		}})
+	}))
+	defer server.Close()
+
+	keys := NewKeySet(server.URL)
+	key, err := keys.Get("sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.N.Cmp(privateKey.N) != 0 || key.E != privateKey.E {
+		t.Fatal("unexpected key", key)
+	}
+	for _, kid := range []string{"enc", "ec", "unknown"} {
+		if _, err := keys.Get(kid); err == nil {
+			t.Fatal("expected error for key id", kid)
+		}
+	}
+	if count := atomic.LoadInt32(&requests); count != 1 {
+		t.Fatal("unknown key ids must not refresh more than once per interval", count)
+	}
+
+	keys.lastRefresh = time.Now().Add(-jwksMinRefreshInterval)
+	if _, err := keys.Get("unknown"); err == nil {
+		t.Fatal("expected error for unknown key id")
+	}
+	if count := atomic.LoadInt32(&requests); count != 2 {
+		t.Fatal("unknown key id must refresh after the interval", count)
+	}
+	if _, err := keys.Get("sig"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/Shopify/sarama"
+	kazoo "github.com/wvanbergen/kazoo-go"
+)
+
+type KafkaBus struct {
+	onceProducer sync.Once
+	producer     sarama.AsyncProducer
+	mux          sync.Mutex
+	closed       bool //sarama panics on input to a closed producer
+	consumers    []sarama.ConsumerGroup
+	cancel       []context.CancelFunc
+	onceClose    sync.Once
+	closeErr     error
+}
+
+type kafkaMessageRef struct {
+	session sarama.ConsumerGroupSession
+	msg     *sarama.ConsumerMessage
+}
+
+func NewKafkaBus() *KafkaBus {
+	return &KafkaBus{}
+}
+
+// returns config.KafkaBrokers; zookeeper is only used to discover the brokers if no broker is configured
+func KafkaBrokerList() (brokers []string, err error) {
+	if len(util.Config.KafkaBrokers) > 0 {
+		return util.Config.KafkaBrokers, nil
+	}
+	log.Println("WARNING: no KafkaBrokers configured; use zookeeper broker discovery", util.Config.ZookeeperUrl)
+	kz, err := kazoo.NewKazooFromConnectionString(util.Config.ZookeeperUrl, nil)
+	if err != nil {
+		log.Println("ERROR: kazoo.NewKazooFromConnectionString()", err)
+		return brokers, err
+	}
+	defer kz.Close()
+	brokers, err = kz.BrokerList()
+	if err != nil {
+		log.Println("ERROR: kz.BrokerList()", err)
+	}
+	return
+}
+
+func SaramaConfig() (conf *sarama.Config, err error) {
+	conf = sarama.NewConfig()
+	conf.Version = sarama.V0_10_2_0 //minimal version for kafka native consumer groups
+	err = applyKafkaSecurity(conf)
+	return
+}
+
+func (this *KafkaBus) getProducer() sarama.AsyncProducer {
+	this.onceProducer.Do(func() {
+		this.producer = InitProducer()
+		go HandleDeliveryReports(this.producer)
+	})
+	return this.producer
+}
+
+func (this *KafkaBus) Publish(msg BusMessage) error {
+	return this.PublishBatch([]BusMessage{msg})[0]
+}
+
+// all messages are handed to the producer before waiting for their delivery reports (sync ack mode)
+func (this *KafkaBus) PublishBatch(msgs []BusMessage) []error {
+	errs := make([]error, len(msgs))
+	results := make([]chan error, len(msgs))
+	//the lock keeps Close() from closing the producer while messages are handed over
+	this.mux.Lock()
+	if this.closed {
+		this.mux.Unlock()
+		for i := range errs {
+			errs[i] = errors.New("kafka bus is closed")
+		}
+		return errs
+	}
+	producer := this.getProducer()
+	for i, msg := range msgs {
+		meta := &deliveryMetadata{}
+		if SyncAck() {
+			meta.result = make(chan error, 1)
+		}
+		results[i] = meta.result
+		var key sarama.Encoder
+		if msg.Key != "" {
+			key = sarama.StringEncoder(msg.Key)
+		}
+		timestamp := msg.Time
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		producer.Input() <- &sarama.ProducerMessage{Topic: msg.Topic, Key: key, Value: sarama.ByteEncoder(msg.Value), Timestamp: timestamp, Metadata: meta}
+	}
+	this.mux.Unlock()
+	for i, result := range results {
+		if result != nil {
+			errs[i] = WaitForDelivery(result)
+		}
+	}
+	return errs
+}
+
+func (this *KafkaBus) Subscribe(topic string) (<-chan *BusMessage, <-chan error, error) {
+	brokers, err := KafkaBrokerList()
+	if err != nil {
+		return nil, nil, err
+	}
+	conf, err := SaramaConfig()
+	if err != nil {
+		log.Println("ERROR: SaramaConfig()", err)
+		return nil, nil, err
+	}
+	conf.Consumer.Return.Errors = util.Config.FatalKafkaErrors == "true"
+	//a new group has no committed offsets (the old zookeeper group is not migrated); do not replay retained commands
+	conf.Consumer.Offsets.Initial = sarama.OffsetNewest
+	group, err := sarama.NewConsumerGroup(brokers, topic, conf)
+	if err != nil {
+		log.Println("ERROR: sarama.NewConsumerGroup()", brokers, err)
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	this.mux.Lock()
+	if this.closed {
+		this.mux.Unlock()
+		cancel()
+		group.Close()
+		return nil, nil, errors.New("kafka bus is closed")
+	}
+	this.consumers = append(this.consumers, group)
+	this.cancel = append(this.cancel, cancel)
+	this.mux.Unlock()
+
+	messages := make(chan *BusMessage)
+	errors := make(chan error, 1)
+	if conf.Consumer.Return.Errors {
+		go func() {
+			for err := range group.Errors() {
+				errors <- err
+			}
+		}()
+	}
+	go func() {
+		defer close(messages)
+		handler := kafkaGroupHandler{messages: messages}
+		for {
+			err := group.Consume(ctx, []string{topic}, handler)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == sarama.ErrClosedConsumerGroup {
+				return
+			}
+			if err != nil {
+				log.Println("ERROR: kafka consumer group", topic, err)
+				if conf.Consumer.Return.Errors {
+					errors <- err
+					return
+				}
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+	return messages, errors, nil
+}
+
+func (this *KafkaBus) Commit(msg *BusMessage) error {
+	ref, ok := msg.ref.(kafkaMessageRef)
+	if !ok {
+		return nil
+	}
+	//marked offsets are committed by the consumer group auto commit
+	ref.session.MarkMessage(ref.msg, "")
+	return nil
+}
+
+// closing the sarama producer twice panics; repeated calls return the result of the first close
+func (this *KafkaBus) Close() error {
+	this.onceClose.Do(func() {
+		this.closeErr = this.close()
+	})
+	return this.closeErr
+}
+
+func (this *KafkaBus) close() (err error) {
+	this.mux.Lock()
+	this.closed = true
+	for _, cancel := range this.cancel {
+		cancel()
+	}
+	for _, consumer := range this.consumers {
+		if closeErr := consumer.Close(); closeErr != nil {
+			log.Println("ERROR: while closing kafka consumer", closeErr)
+			err = closeErr
+		}
+	}
+	this.consumers = nil
+	this.cancel = nil
+	this.mux.Unlock()
+	if this.producer != nil {
+		if closeErr := this.producer.Close(); closeErr != nil {
+			log.Println("ERROR: while closing kafka producer", closeErr)
+			err = closeErr
+		}
+	}
+	return
+}
+
+type kafkaGroupHandler struct {
+	messages chan<- *BusMessage
+}
+
+func (this kafkaGroupHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (this kafkaGroupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (this kafkaGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		select {
+		case this.messages <- &BusMessage{Topic: msg.Topic, Key: string(msg.Key), Value: msg.Value, Time: msg.Timestamp, ref: kafkaMessageRef{session: session, msg: msg}}:
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+	return nil
+}
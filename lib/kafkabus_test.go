@@ -0,0 +1,35 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"testing"
+)
+
+func TestKafkaBusClosed(t *testing.T) {
+	bus := NewKafkaBus()
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+	errs := bus.PublishBatch([]BusMessage{{Topic: "topic"}, {Topic: "topic"}})
+	if len(errs) != 2 || errs[0] == nil || errs[1] == nil {
+		t.Fatal("expected errors on publish to a closed bus", errs)
+	}
+	if err := bus.Publish(BusMessage{Topic: "topic"}); err == nil {
+		t.Fatal("expected error on publish to a closed bus")
+	}
+}
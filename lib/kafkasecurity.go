@@ -0,0 +1,110 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// applies the configured tls and sasl settings to producer and consumer configs
+func applyKafkaSecurity(conf *sarama.Config) (err error) {
+	if util.Config.KafkaTls == "true" {
+		conf.Net.TLS.Enable = true
+		conf.Net.TLS.Config, err = KafkaTlsConfig()
+		if err != nil {
+			return err
+		}
+	}
+	switch util.Config.KafkaSaslMechanism {
+	case "":
+		return nil
+	case sarama.SASLTypePlaintext:
+		conf.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		conf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha256.New}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		conf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha512.New}
+		}
+	default:
+		return errors.New("unknown kafka sasl mechanism: " + util.Config.KafkaSaslMechanism)
+	}
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.Handshake = true
+	conf.Net.SASL.User = util.Config.KafkaSaslUser
+	conf.Net.SASL.Password = util.Config.KafkaSaslPassword
+	return nil
+}
+
+func KafkaTlsConfig() (result *tls.Config, err error) {
+	result = &tls.Config{InsecureSkipVerify: util.Config.KafkaTlsSkipVerify == "true"}
+	if util.Config.KafkaTlsCaFile != "" {
+		ca, err := ioutil.ReadFile(util.Config.KafkaTlsCaFile)
+		if err != nil {
+			return result, err
+		}
+		result.RootCAs = x509.NewCertPool()
+		if !result.RootCAs.AppendCertsFromPEM(ca) {
+			return result, errors.New("no valid certificate found in " + util.Config.KafkaTlsCaFile)
+		}
+	}
+	if util.Config.KafkaTlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(util.Config.KafkaTlsCertFile, util.Config.KafkaTlsKeyFile)
+		if err != nil {
+			return result, err
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+	return result, nil
+}
+
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (this *scramClient) Begin(userName, password, authzID string) (err error) {
+	this.Client, err = this.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	this.ClientConversation = this.Client.NewConversation()
+	return nil
+}
+
+func (this *scramClient) Step(challenge string) (response string, err error) {
+	return this.ClientConversation.Step(challenge)
+}
+
+func (this *scramClient) Done() bool {
+	return this.ClientConversation.Done()
+}
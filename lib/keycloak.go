@@ -34,9 +34,14 @@ type OpenidToken struct {
 	RequestTime      time.Time `json:"-"`
 }
 
-func GetOpenidToken(username, password string, token *OpenidToken) (err error) {
+// password grant at the token endpoint of the realm; the default realm is used if realm is empty
+func GetOpenidToken(realm, username, password string, token *OpenidToken) (err error) {
 	requesttime := time.Now()
-	resp, err := http.PostForm(util.Config.AuthEndpoint+"/auth/realms/master/protocol/openid-connect/token", url.Values{
+	provider, err := Provider(realm)
+	if err != nil {
+		return err
+	}
+	resp, err := http.PostForm(provider.TokenEndpoint, url.Values{
 		"client_id":     {util.Config.AuthClientId},
 		"client_secret": {util.Config.AuthClientSecret},
 		"username":      {username},
@@ -56,9 +61,13 @@ func GetOpenidToken(username, password string, token *OpenidToken) (err error) {
 	return
 }
 
-func RefreshOpenidToken(token *OpenidToken) (err error) {
+func RefreshOpenidToken(realm string, token *OpenidToken) (err error) {
 	requesttime := time.Now()
-	resp, err := http.PostForm(util.Config.AuthEndpoint+"/auth/realms/master/protocol/openid-connect/token", url.Values{
+	provider, err := Provider(realm)
+	if err != nil {
+		return err
+	}
+	resp, err := http.PostForm(provider.TokenEndpoint, url.Values{
 		"client_id":     {util.Config.AuthClientId},
 		"client_secret": {util.Config.AuthClientSecret},
 		"refresh_token": {token.RefreshToken},
@@ -76,3 +85,53 @@ func RefreshOpenidToken(token *OpenidToken) (err error) {
 	token.RequestTime = requesttime
 	return
 }
+
+func serviceClient() (clientId string, clientSecret string) {
+	if util.Config.AuthServiceClientId != "" {
+		return util.Config.AuthServiceClientId, util.Config.AuthServiceClientSecret
+	}
+	return util.Config.AuthClientId, util.Config.AuthClientSecret
+}
+
+// client credentials grant of the service account; used for gateways authenticated by client certificates
+func GetServiceAccountToken(realm string, token *OpenidToken) (err error) {
+	clientId, clientSecret := serviceClient()
+	return requestToken(realm, token, url.Values{
+		"client_id":     {clientId},
+		"client_secret": {clientSecret},
+		"grant_type":    {"client_credentials"},
+	})
+}
+
+// exchanges a token of the service account for a token of the user (requires token exchange permissions of the service client)
+func ExchangeToken(realm string, subjectToken string, user string, token *OpenidToken) (err error) {
+	clientId, clientSecret := serviceClient()
+	return requestToken(realm, token, url.Values{
+		"client_id":            {clientId},
+		"client_secret":        {clientSecret},
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":        {subjectToken},
+		"requested_subject":    {user},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:refresh_token"},
+	})
+}
+
+func requestToken(realm string, token *OpenidToken, values url.Values) (err error) {
+	requesttime := time.Now()
+	provider, err := Provider(realm)
+	if err != nil {
+		return err
+	}
+	resp, err := http.PostForm(provider.TokenEndpoint, values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errors.New("access denied")
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(token)
+	token.RequestTime = requesttime
+	return
+}
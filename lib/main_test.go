@@ -0,0 +1,175 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/model"
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/SmartEnergyPlatform/formatter-lib"
+	iot_model "github.com/SmartEnergyPlatform/iot-device-repository/lib/model"
+)
+
+// tests use the in-memory message bus; every test subscribes to the topics it checks
+func TestMain(m *testing.M) {
+	util.Config = testConfig()
+	SetBus(NewMemoryBus())
+	os.Exit(m.Run())
+}
+
+func testConfig() *util.ConfigStruct {
+	config := &util.ConfigStruct{
+		MessageBus:                  "memory",
+		KafkaEventTopic:             "events",
+		KafkaResponseTopic:          "responses",
+		KafkaCommandDeadLetterTopic: "dead_letters",
+		WsQueueSize:                 10,
+		WsPingperiod:                60,
+		WsTimeout:                   10,
+		CommandBufferSize:           2,
+		CommandBufferTtl:            3600,
+		EventDedupWindow:            3600,
+		EventMaxPastSkew:            3600,
+		EventMaxFutureSkew:          60,
+	}
+	util.HandleDefaultValues(config)
+	return config
+}
+
+// replaces util.Config for the duration of a test
+func withConfig(t *testing.T, change func(config *util.ConfigStruct)) {
+	previous := util.Config
+	config := *previous
+	change(&config)
+	util.Config = &config
+	t.Cleanup(func() {
+		util.Config = previous
+	})
+}
+
+func subscribe(t *testing.T, topic string) <-chan *BusMessage {
+	messages, _, err := Bus().Subscribe(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func receive(t *testing.T, messages <-chan *BusMessage) *BusMessage {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("timeout while waiting for message")
+		return nil
+	}
+}
+
+func expectNoMessage(t *testing.T, messages <-chan *BusMessage) {
+	select {
+	case msg := <-messages:
+		t.Fatal("unexpected message", msg.Topic, string(msg.Value))
+	default:
+	}
+}
+
+// session with a test transport and without writer; outbound messages stay in session.outbox
+func testSession(devices ...model.DeviceServiceEntity) *Session {
+	session := &Session{
+		Id:                         "session-" + time.Now().String(),
+		Cred:                       &Credentials{User: "user", Openid: &OpenidToken{AccessToken: "token", ExpiresIn: 3600, RequestTime: time.Now()}},
+		UriCache:                   map[string]model.DeviceServiceEntity{},
+		eventTransformerCollection: map[string]formatter_lib.EventTransformer{},
+		outbox:                     newOutbox(),
+		writerDone:                 make(chan bool),
+		stopPing:                   make(chan bool),
+		transport:                  &testTransport{},
+		traffic:                    &trafficCounter{},
+	}
+	for _, device := range devices {
+		session.UriCache[device.Device.Url] = device
+		session.Prefixes = append(session.Prefixes, device.Device.Id)
+		for _, service := range device.Services {
+			//a transformer without outputs formats every event value as {}
+			session.eventTransformerCollection[device.Device.Id+"."+service.Id] = formatter_lib.EventTransformer{}
+		}
+	}
+	return session
+}
+
+func testDevice(id string, uri string, serviceIds ...string) model.DeviceServiceEntity {
+	entity := model.DeviceServiceEntity{Device: iot_model.DeviceInstance{Id: id, Url: uri}}
+	for _, serviceId := range serviceIds {
+		entity.Services = append(entity.Services, model.ShortService{Id: serviceId, Url: serviceId + "_uri"})
+	}
+	return entity
+}
+
+type testTransport struct {
+	mux     sync.Mutex
+	err     error //returned by Write
+	written []outboundMessage
+	closed  bool
+}
+
+func (this *testTransport) Name() string {
+	return "test"
+}
+
+func (this *testTransport) Write(msg outboundMessage) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.err != nil {
+		return this.err
+	}
+	this.written = append(this.written, msg)
+	return nil
+}
+
+func (this *testTransport) WriteControl(msgType int, data []byte) error {
+	return nil
+}
+
+func (this *testTransport) Close() error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.closed = true
+	return nil
+}
+
+func (this *testTransport) Traffic() *trafficCounter {
+	return &trafficCounter{}
+}
+
+// skips dead letters of other devices
+func receiveDeadLetter(t *testing.T, deadLetters <-chan *BusMessage, prefix string) UndeliverableCommand {
+	for {
+		letter := UndeliverableCommand{}
+		if err := json.Unmarshal(receive(t, deadLetters).Value, &letter); err != nil {
+			t.Fatal(err)
+		}
+		if letter.DeviceId == prefix {
+			return letter
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"errors"
+	"sync"
+)
+
+const memoryBusQueueSize = 1000
+
+// in-memory message bus for tests and local development; messages are delivered to subscribers of the same process only
+type MemoryBus struct {
+	mux         sync.Mutex
+	subscribers map[string][]chan *BusMessage
+	closed      bool
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subscribers: map[string][]chan *BusMessage{}}
+}
+
+func (this *MemoryBus) Publish(msg BusMessage) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.closed {
+		return errors.New("memory bus is closed")
+	}
+	for _, subscriber := range this.subscribers[msg.Topic] {
+		value := make([]byte, len(msg.Value))
+		copy(value, msg.Value)
+		//non-blocking to prevent deadlocks if a subscriber publishes to its own topic
+		select {
+		case subscriber <- &BusMessage{Topic: msg.Topic, Key: msg.Key, Value: value, Time: msg.Time}:
+		default:
+			return errors.New("memory bus queue for topic '" + msg.Topic + "' is full")
+		}
+	}
+	return nil
+}
+
+func (this *MemoryBus) PublishBatch(msgs []BusMessage) (result []error) {
+	for _, msg := range msgs {
+		result = append(result, this.Publish(msg))
+	}
+	return
+}
+
+func (this *MemoryBus) Subscribe(topic string) (<-chan *BusMessage, <-chan error, error) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.closed {
+		return nil, nil, errors.New("memory bus is closed")
+	}
+	messages := make(chan *BusMessage, memoryBusQueueSize)
+	this.subscribers[topic] = append(this.subscribers[topic], messages)
+	return messages, make(chan error), nil
+}
+
+func (this *MemoryBus) Commit(msg *BusMessage) error {
+	return nil
+}
+
+func (this *MemoryBus) Close() error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	for _, subscribers := range this.subscribers {
+		for _, subscriber := range subscribers {
+			close(subscriber)
+		}
+	}
+	this.subscribers = map[string][]chan *BusMessage{}
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"testing"
+)
+
+func TestMemoryBusPublish(t *testing.T) {
+	bus := NewMemoryBus()
+	first, _, err := bus.Subscribe("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := bus.Subscribe("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := bus.Subscribe("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := []byte("value")
+	errs := bus.PublishBatch([]BusMessage{{Topic: "topic", Key: "key", Value: value}, {Topic: "unused", Value: value}})
+	if len(errs) != 2 || errs[0] != nil || errs[1] != nil {
+		t.Fatal("unexpected publish result", errs)
+	}
+	value[0] = 'V'
+
+	for _, messages := range []<-chan *BusMessage{first, second} {
+		msg := receive(t, messages)
+		if msg.Topic != "topic" || msg.Key != "key" || string(msg.Value) != "value" {
+			t.Fatal("unexpected message", msg.Topic, msg.Key, string(msg.Value))
+		}
+	}
+	expectNoMessage(t, other)
+}
+
+func TestMemoryBusClose(t *testing.T) {
+	bus := NewMemoryBus()
+	messages, _, err := bus.Subscribe("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-messages; ok {
+		t.Fatal("subscriptions must be closed with the bus")
+	}
+	if err = bus.Publish(BusMessage{Topic: "topic"}); err == nil {
+		t.Fatal("expected error on publish to a closed bus")
+	}
+	if _, _, err = bus.Subscribe("topic"); err == nil {
+		t.Fatal("expected error on subscribe to a closed bus")
+	}
+	if err = bus.Close(); err != nil {
+		t.Fatal("repeated Close() must not fail", err)
+	}
+}
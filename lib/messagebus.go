@@ -0,0 +1,63 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+type BusMessage struct {
+	Topic string
+	Key   string //used for partitioning; empty for random partitions
+	Value []byte
+	Time  time.Time   //zero value for the time of publishing
+	ref   interface{} //backend specific reference used by Commit()
+}
+
+type MessageBus interface {
+	Publish(msg BusMessage) error
+	PublishBatch(msgs []BusMessage) []error //returns one error (or nil) per message
+	Subscribe(topic string) (messages <-chan *BusMessage, errors <-chan error, err error)
+	Commit(msg *BusMessage) error
+	Close() error
+}
+
+var messageBus MessageBus
+var onceMessageBus sync.Once
+
+func Bus() MessageBus {
+	onceMessageBus.Do(func() {
+		switch util.Config.MessageBus {
+		case "memory":
+			log.Println("use in-memory message bus")
+			messageBus = NewMemoryBus()
+		default:
+			messageBus = NewKafkaBus()
+		}
+	})
+	return messageBus
+}
+
+// replaces the message bus returned by Bus(); must be called before the first use of Bus()
+func SetBus(bus MessageBus) {
+	onceMessageBus.Do(func() {})
+	messageBus = bus
+}
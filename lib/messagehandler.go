@@ -20,15 +20,19 @@ import (
 	"github.com/SmartEnergyPlatform/platform-connector/model"
 	"github.com/SmartEnergyPlatform/platform-connector/util"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/SmartEnergyPlatform/formatter-lib"
 )
 
 type MessageHandlerFunction func(session *Session, request Request)
 
+// handlers of the legacy protocol version; see protocolHandlers for handlers of newer versions
 var MessageHandler = map[string]MessageHandlerFunction{
 	"clear":      clear,
 	"commit":     commit,
@@ -90,7 +94,19 @@ func response(session *Session, request Request) {
 		request.UserError("ERROR: cannot parse response msg: " + err.Error())
 		return
 	}
-	Produce(util.Config.KafkaResponseTopic, string(msg))
+	key := ""
+	if payload, ok := request.RawPayload.(map[string]interface{}); ok {
+		key, _ = payload["device_instance_id"].(string)
+		if id := CommandCorrelationId(payload); id != "" && util.Config.CommandTimeout > 0 && !Commands().Resolve(id) {
+			log.Println("WARNING: response to unknown or expired command", id)
+		}
+	}
+	err = Produce(util.Config.KafkaResponseTopic, key, string(msg))
+	if err != nil {
+		log.Println("ERROR: response::Produce", err)
+		request.Error(err.Error())
+		return
+	}
 	request.Respond("ok")
 }
 
@@ -203,6 +219,11 @@ func formatEvent(session *Session, deviceid string, serviceid string, event form
 	return formater.Transform(event)
 }
 
+type EventStatus struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
 func event(session *Session, request Request) {
 	event := model.EventMessage{}
 	err := request.Payload(&event)
@@ -211,32 +232,153 @@ func event(session *Session, request Request) {
 		log.Println("error event: ", err)
 		return
 	}
+	prepared, status, err := prepareEvent(session, event)
+	if err != nil {
+		log.Println("error event: ", err)
+		if status == 400 {
+			request.UserError(err.Error())
+		} else {
+			request.Error(err.Error())
+		}
+		return
+	}
+	if prepared.duplicate {
+		request.Respond("ok")
+		return
+	}
+	for _, err = range ProduceBatch(prepared.msgs) {
+		if err != nil {
+			log.Println("ERROR: event::Produce", err)
+			Dedup().Release(prepared.deviceId, prepared.messageId)
+			request.Error(err.Error())
+			return
+		}
+	}
+	metricEvents.Inc()
+	request.Respond("ok")
+}
+
+// batch of events; the response payload contains a status for each event
+func events(session *Session, request Request) {
+	events := []model.EventMessage{}
+	err := request.Payload(&events)
+	if err != nil {
+		request.UserError(err.Error())
+		log.Println("error events: ", err)
+		return
+	}
+	if util.Config.MaxEventBatchSize > 0 && int64(len(events)) > util.Config.MaxEventBatchSize {
+		request.UserError("too many events in batch; max " + strconv.FormatInt(util.Config.MaxEventBatchSize, 10))
+		return
+	}
+	request.Respond(produceEvents(session, events))
+}
+
+// produces a batch of events and returns the status of each event
+func produceEvents(session *Session, events []model.EventMessage) (result []EventStatus) {
+	result = make([]EventStatus, len(events))
+	prepared := make([]preparedEvent, len(events))
+	msgs := []BusMessage{}
+	msgIndex := []int{}           //event index of each message
+	claimedBy := map[string]int{} //device id and message id -> index of the event claiming it in this batch
+	repeated := map[int]int{}     //index of an in-batch duplicate -> index of the claiming event
+	for i, event := range events {
+		var status int
+		var err error
+		prepared[i], status, err = prepareEvent(session, event)
+		if err != nil {
+			log.Println("error events: ", i, err)
+			result[i] = EventStatus{Status: status, Error: err.Error()}
+			continue
+		}
+		result[i] = EventStatus{Status: 200}
+		if prepared[i].messageId != "" {
+			key := prepared[i].deviceId + "/" + prepared[i].messageId
+			if claimant, ok := claimedBy[key]; ok && prepared[i].duplicate {
+				repeated[i] = claimant
+			} else if !prepared[i].duplicate {
+				claimedBy[key] = i
+			}
+		}
+		for _, msg := range prepared[i].msgs {
+			msgs = append(msgs, msg)
+			msgIndex = append(msgIndex, i)
+		}
+	}
+	for i, err := range ProduceBatch(msgs) {
+		if err != nil {
+			log.Println("ERROR: events::Produce", err)
+			result[msgIndex[i]] = EventStatus{Status: 500, Error: err.Error()}
+		}
+	}
+	//a duplicate within the batch shares the outcome of the event claiming its message id
+	for i, claimant := range repeated {
+		if result[claimant].Status != 200 {
+			result[i] = EventStatus{Status: result[claimant].Status, Error: result[claimant].Error}
+		}
+	}
+	for i, status := range result {
+		if _, ok := repeated[i]; ok {
+			continue
+		}
+		if status.Status == 500 && prepared[i].messageId != "" {
+			Dedup().Release(prepared[i].deviceId, prepared[i].messageId)
+		}
+		if status.Status == 200 && !prepared[i].duplicate {
+			metricEvents.Inc()
+		}
+	}
+	return result
+}
+
+type preparedEvent struct {
+	deviceId  string
+	messageId string
+	duplicate bool //already produced within config.EventDedupWindow; msgs is empty
+	msgs      []BusMessage
+}
+
+// formats the event and returns the kafka messages for the service topic and config.KafkaEventTopic;
+// the returned status is 400 for errors caused by the gateway and 500 otherwise
+func prepareEvent(session *Session, event model.EventMessage) (result preparedEvent, status int, err error) {
+	err = validateEventTime(event.Time)
+	if err != nil {
+		return result, 400, err
+	}
 	session.Mux.Lock()
 	entity, ok := session.UriCache[event.DeviceUri]
 	session.Mux.Unlock()
 	if !ok {
-		errMsg := "error event: not listen to this device " + fmt.Sprint(event)
-		request.UserError(errMsg)
-		log.Println(errMsg)
-		return
+		return result, 400, errors.New("error event: not listen to this device " + fmt.Sprint(event))
+	}
+	result.deviceId = entity.Device.Id
+	result.messageId = event.MessageId
+	if !Dedup().Claim(result.deviceId, result.messageId) {
+		log.Println("drop duplicate event", result.deviceId, result.messageId)
+		metricDuplicateEvents.Inc()
+		result.duplicate = true
+		return result, 200, nil
 	}
+	defer func() {
+		if err != nil {
+			Dedup().Release(result.deviceId, result.messageId)
+		}
+	}()
 	for _, service := range entity.Services {
 		if service.Url == event.ServiceUri {
 			serviceTopic := formatId(service.Id)
-			prefixMsg := model.PrefixMessage{DeviceId: entity.Device.Id, ServiceId: service.Id}
+			prefixMsg := model.PrefixMessage{DeviceId: entity.Device.Id, ServiceId: service.Id, Time: event.Time}
 
 			var eventValue interface{}
 			formatedEvent, err := formatEvent(session, entity.Device.Id, service.Id, event.Value)
 			if err != nil {
 				log.Println("ERROR: formatEvent() ", err)
-				request.Error(err.Error())
-				return
+				return result, 500, err
 			}
 			err = json.Unmarshal([]byte(formatedEvent), &eventValue)
 			if err != nil {
 				log.Println("ERROR: formatedEvent unmarshaling ", err)
-				request.Error(err.Error())
-				return
+				return result, 500, err
 			}
 
 			prefixMsg.Value = eventValue
@@ -244,17 +386,37 @@ func event(session *Session, request Request) {
 			jsonPrefixMsg, err := json.Marshal(prefixMsg)
 			if err != nil {
 				log.Println("ERROR: creating jsonPrefixMsg failed: ", err)
-				request.Error(err.Error())
-			} else {
-				Produce(serviceTopic, string(jsonPrefixMsg))
-				Produce(util.Config.KafkaEventTopic, string(jsonPrefixMsg))
-				request.Respond("ok")
+				return result, 500, err
 			}
-			return
+			key := EventKey(entity.Device.Id, service.Id)
+			var timestamp time.Time
+			if event.Time != nil {
+				timestamp = *event.Time
+			}
+			result.msgs = []BusMessage{
+				{Topic: serviceTopic, Key: key, Value: jsonPrefixMsg, Time: timestamp},
+				{Topic: util.Config.KafkaEventTopic, Key: key, Value: jsonPrefixMsg, Time: timestamp},
+			}
+			return result, 200, nil
 		}
 	}
 	log.Println("debug: ", entity, session.UriCache)
-	request.UserError("no matching service to '" + event.ServiceUri + "' found in" + fmt.Sprintln(entity.Services))
+	return result, 400, errors.New("no matching service to '" + event.ServiceUri + "' found in" + fmt.Sprintln(entity.Services))
+}
+
+// checks the optional device timestamp against config.EventMaxPastSkew and config.EventMaxFutureSkew
+func validateEventTime(eventTime *time.Time) error {
+	if eventTime == nil {
+		return nil
+	}
+	skew := time.Since(*eventTime)
+	if util.Config.EventMaxPastSkew > 0 && skew > time.Duration(util.Config.EventMaxPastSkew)*time.Second {
+		return errors.New("event time " + eventTime.String() + " is too far in the past")
+	}
+	if util.Config.EventMaxFutureSkew > 0 && -skew > time.Duration(util.Config.EventMaxFutureSkew)*time.Second {
+		return errors.New("event time " + eventTime.String() + " is too far in the future")
+	}
+	return nil
 }
 
 func formatId(id string) string {
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/model"
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+func TestProduceEvents(t *testing.T) {
+	events := subscribe(t, "events")
+	serviceEvents := subscribe(t, "service")
+	session := testSession(testDevice("device", "device_uri", "service"))
+	eventTime := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	old := time.Now().Add(-2 * time.Hour)
+	//message ids are unique per test run because the deduplicator is shared
+	messageId := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	cases := []struct {
+		name     string
+		events   []model.EventMessage
+		statuses []int
+		produced int
+	}{
+		{
+			name:     "single event",
+			events:   []model.EventMessage{{DeviceUri: "device_uri", ServiceUri: "service_uri"}},
+			statuses: []int{200},
+			produced: 1,
+		},
+		{
+			name: "batch with errors",
+			events: []model.EventMessage{
+				{DeviceUri: "device_uri", ServiceUri: "service_uri", Time: &eventTime},
+				{DeviceUri: "unknown_uri", ServiceUri: "service_uri"},
+				{DeviceUri: "device_uri", ServiceUri: "unknown_uri"},
+				{DeviceUri: "device_uri", ServiceUri: "service_uri", Time: &old},
+			},
+			statuses: []int{200, 400, 400, 400},
+			produced: 1,
+		},
+		{
+			name: "duplicate message ids",
+			events: []model.EventMessage{
+				{DeviceUri: "device_uri", ServiceUri: "service_uri", MessageId: messageId + "_1"},
+				{DeviceUri: "device_uri", ServiceUri: "service_uri", MessageId: messageId + "_1"},
+				{DeviceUri: "device_uri", ServiceUri: "service_uri", MessageId: messageId + "_2"},
+			},
+			statuses: []int{200, 200, 200},
+			produced: 2,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result := produceEvents(session, c.events)
+			if len(result) != len(c.statuses) {
+				t.Fatal("unexpected result length", result)
+			}
+			for i, status := range c.statuses {
+				if result[i].Status != status {
+					t.Fatal("unexpected status of event", i, result[i])
+				}
+			}
+			for i := 0; i < c.produced; i++ {
+				msg := receive(t, events)
+				if msg.Key != "device" {
+					t.Fatal("unexpected key", msg.Key)
+				}
+				prefixMsg := model.PrefixMessage{}
+				if err := json.Unmarshal(msg.Value, &prefixMsg); err != nil {
+					t.Fatal(err)
+				}
+				if prefixMsg.DeviceId != "device" || prefixMsg.ServiceId != "service" {
+					t.Fatal("unexpected event", string(msg.Value))
+				}
+				if prefixMsg.Time != nil && !prefixMsg.Time.Equal(eventTime) {
+					t.Fatal("unexpected event time", prefixMsg.Time)
+				}
+				receive(t, serviceEvents)
+			}
+			expectNoMessage(t, events)
+			expectNoMessage(t, serviceEvents)
+		})
+	}
+}
+
+func TestValidateEventTime(t *testing.T) {
+	past := time.Now().Add(-2 * time.Hour)
+	recent := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	cases := []struct {
+		name       string
+		time       *time.Time
+		maxPast    int64
+		maxFuture  int64
+		shouldFail bool
+	}{
+		{name: "no time", time: nil, maxPast: 60, maxFuture: 60},
+		{name: "recent", time: &recent, maxPast: 3600, maxFuture: 60},
+		{name: "too far in the past", time: &past, maxPast: 3600, maxFuture: 60, shouldFail: true},
+		{name: "unlimited past", time: &past, maxPast: 0, maxFuture: 60},
+		{name: "too far in the future", time: &future, maxPast: 3600, maxFuture: 60, shouldFail: true},
+		{name: "unlimited future", time: &future, maxPast: 3600, maxFuture: 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			withConfig(t, func(config *util.ConfigStruct) {
+				config.EventMaxPastSkew = c.maxPast
+				config.EventMaxFutureSkew = c.maxFuture
+			})
+			err := validateEventTime(c.time)
+			if (err != nil) != c.shouldFail {
+				t.Fatal("unexpected result", err)
+			}
+		})
+	}
+}
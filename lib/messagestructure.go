@@ -18,6 +18,7 @@ package lib
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"reflect"
 )
@@ -32,28 +33,29 @@ type Message struct {
 
 func (this Message) Str() string {
 	errmsg := "ERROR: unable to create response"
-	if this.Payload == nil {
-		log.Println(errmsg + " (payload is nil)")
+	msg, err := this.Encode(JsonCodec)
+	if err != nil {
+		log.Println(errmsg, err)
 		return errmsg
 	}
+	return string(msg)
+}
+
+func (this Message) Encode(codec Codec) (result []byte, err error) {
+	if this.Payload == nil {
+		return result, errors.New("payload is nil")
+	}
 	temp, err := json.Marshal(this.Payload)
 	if err != nil {
-		log.Println(errmsg, err)
-		return errmsg
+		return result, err
 	}
 	var ct interface{}
 	err = json.Unmarshal(temp, &ct)
 	if err != nil {
-		log.Println(errmsg, err)
-		return errmsg
+		return result, err
 	}
 	this.ContentType = reflect.TypeOf(ct).Kind().String()
-	msg, err := json.Marshal(this)
-	if err != nil {
-		log.Println(errmsg, err)
-		return errmsg
-	}
-	return string(msg)
+	return codec.Marshal(this)
 }
 
 type RawRequest struct {
@@ -62,11 +64,11 @@ type RawRequest struct {
 	Payload interface{} `json:"payload,omitempty"`
 }
 
-func (session *Session) NewRequest(message string) (result Request, err error) {
+func (session *Session) NewRequest(message []byte) (result Request, err error) {
 	raw := RawRequest{}
-	err = json.Unmarshal([]byte(message), &raw)
+	err = session.Codec().Unmarshal(message, &raw)
 	if err != nil {
-		log.Println("ERROR: unable to parse request from message ("+message+")", err)
+		log.Println("ERROR: unable to parse request from message ("+session.describeFrame(message)+")", err)
 		return
 	}
 
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricHandlerRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "connector_handler_requests_total",
+		Help: "Number of handled websocket requests by handler.",
+	}, []string{"handler"})
+	metricHandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "connector_handler_duration_seconds",
+		Help:    "Duration of websocket request handling by handler.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+	metricErrorResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "connector_error_responses_total",
+		Help: "Number of error responses sent to gateways by status.",
+	}, []string{"status"})
+	metricEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "connector_events_total",
+		Help: "Number of events received from gateways and produced to kafka.",
+	})
+	metricDuplicateEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "connector_duplicate_events_total",
+		Help: "Number of events acknowledged without producing because their message id was already seen.",
+	})
+	metricKafkaProduced = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "connector_kafka_produced_messages_total",
+		Help: "Number of messages handed to the message bus.",
+	})
+	metricKafkaProduceErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "connector_kafka_produce_errors_total",
+		Help: "Number of messages rejected by the message bus.",
+	})
+	metricKafkaConsumed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "connector_kafka_consumed_messages_total",
+		Help: "Number of commands consumed from kafka.",
+	})
+	metricRepositoryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "connector_repository_request_duration_seconds",
+		Help:    "Duration of requests to the pts and iot repository by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"repository", "operation", "result"})
+	metricTokenFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "connector_token_failures_total",
+		Help: "Number of failed openid token requests by grant type.",
+	}, []string{"grant"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricHandlerRequests,
+		metricHandlerDuration,
+		metricErrorResponses,
+		metricEvents,
+		metricDuplicateEvents,
+		metricKafkaProduced,
+		metricKafkaProduceErrors,
+		metricKafkaConsumed,
+		metricRepositoryDuration,
+		metricTokenFailures,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "connector_sessions",
+			Help: "Number of connected gateway sessions.",
+		}, func() float64 {
+			sessions, _ := sessionCounts()
+			return float64(sessions)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "connector_devices",
+			Help: "Number of devices listened to by connected sessions.",
+		}, func() float64 {
+			_, devices := sessionCounts()
+			return float64(devices)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "connector_kafka_delivery_successes_total",
+			Help: "Number of successful kafka deliveries.",
+		}, func() float64 {
+			return float64(GetDeliveryStats().Successes)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "connector_kafka_delivery_errors_total",
+			Help: "Number of failed kafka deliveries.",
+		}, func() float64 {
+			return float64(GetDeliveryStats().Errors)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "connector_kafka_dead_letters_total",
+			Help: "Number of failed kafka deliveries written as dead letter.",
+		}, func() float64 {
+			return float64(GetDeliveryStats().DeadLetters)
+		}),
+	)
+}
+
+func sessionCounts() (sessions int, devices int) {
+	if sessionsCollection == nil {
+		return 0, 0
+	}
+	return sessionsCollection.Count()
+}
+
+func observeHandler(handler string, start time.Time) {
+	if _, ok := HandlerFor(CurrentProtocolVersion, handler); !ok {
+		handler = "unknown"
+	}
+	metricHandlerRequests.WithLabelValues(handler).Inc()
+	metricHandlerDuration.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+}
+
+func observeErrorResponse(status int) {
+	metricErrorResponses.WithLabelValues(strconv.Itoa(status)).Inc()
+}
+
+// usage: defer observeRepositoryCall("iot", "GetGateway", time.Now(), &err)
+func observeRepositoryCall(repository string, operation string, start time.Time, err *error) {
+	result := "success"
+	if err != nil && *err != nil {
+		result = "error"
+	}
+	metricRepositoryDuration.WithLabelValues(repository, operation, result).Observe(time.Since(start).Seconds())
+}
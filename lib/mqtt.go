@@ -0,0 +1,334 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+	"github.com/satori/go.uuid"
+)
+
+const mqttInboxSize = 100
+
+// connects gateways to sessions using the mqtt topics {prefix}/{client}/handshake and {prefix}/{client}/{handler}
+// from the gateway and {prefix}/{client}/out/response|command|disconnect to the gateway
+type MqttBridge struct {
+	client   mqtt.Client
+	mux      sync.Mutex
+	gateways map[string]*mqttGateway //mqtt client id of the gateway -> state
+}
+
+type mqttGateway struct {
+	clientId string
+	inbox    chan mqtt.Message
+	mux      sync.Mutex
+	session  *Session          //nil until a handshake succeeded
+	secret   [sha256.Size]byte //hash of the session secret every request envelope has to contain
+}
+
+// field of the request envelope binding the request to the session of the handshake
+type mqttSessionEnvelope struct {
+	Session string `json:"session,omitempty"`
+}
+
+var mqttBridge *MqttBridge
+var mqttBridgeMux sync.Mutex
+
+func MqttEnabled() bool {
+	return util.Config.MqttBroker != ""
+}
+
+func StartMqtt() (err error) {
+	if !MqttEnabled() {
+		return nil
+	}
+	bridge := &MqttBridge{gateways: map[string]*mqttGateway{}}
+	clientId := util.Config.MqttClientId
+	if clientId == "" {
+		clientId = "platform-connector-" + uuid.NewV4().String()
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(util.Config.MqttBroker).
+		SetClientID(clientId).
+		SetUsername(util.Config.MqttUser).
+		SetPassword(util.Config.MqttPassword).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			topic := util.Config.MqttTopicPrefix + "/+/+"
+			log.Println("mqtt connected; subscribe to", topic)
+			token := client.Subscribe(topic, byte(util.Config.MqttQos), bridge.dispatch)
+			if token.Wait() && token.Error() != nil {
+				log.Println("ERROR: unable to subscribe to mqtt topic", topic, token.Error())
+			}
+		}).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Println("WARNING: lost mqtt connection", err)
+		})
+	bridge.client = mqtt.NewClient(options)
+	token := bridge.client.Connect()
+	if token.WaitTimeout(time.Duration(util.Config.WsTimeout)*time.Second) && token.Error() != nil {
+		return token.Error()
+	}
+	mqttBridgeMux.Lock()
+	mqttBridge = bridge
+	mqttBridgeMux.Unlock()
+	return nil
+}
+
+// disconnects from the broker; sessions have to be closed before
+func StopMqtt() {
+	mqttBridgeMux.Lock()
+	defer mqttBridgeMux.Unlock()
+	if mqttBridge != nil {
+		mqttBridge.client.Disconnect(uint(outboxDrainTimeout / time.Millisecond))
+		mqttBridge = nil
+	}
+}
+
+func checkMqtt() error {
+	mqttBridgeMux.Lock()
+	defer mqttBridgeMux.Unlock()
+	if mqttBridge == nil || !mqttBridge.client.IsConnectionOpen() {
+		return errors.New("not connected to mqtt broker")
+	}
+	return nil
+}
+
+func mqttIdleTimeout() time.Duration {
+	if util.Config.MqttIdleTimeout > 0 {
+		return time.Duration(util.Config.MqttIdleTimeout) * time.Second
+	}
+	return time.Duration(util.Config.WsTimeout) * time.Second
+}
+
+// splits {prefix}/{client}/{handler}
+func mqttTopicParts(topic string) (clientId string, handler string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(topic, util.Config.MqttTopicPrefix+"/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func (this *MqttBridge) topic(clientId string, name string) string {
+	return util.Config.MqttTopicPrefix + "/" + clientId + "/out/" + name
+}
+
+func (this *MqttBridge) publish(topic string, payload []byte) error {
+	token := this.client.Publish(topic, byte(util.Config.MqttQos), false, payload)
+	if !token.WaitTimeout(time.Duration(util.Config.WsTimeout) * time.Second) {
+		return errors.New("timeout while publishing to " + topic)
+	}
+	return token.Error()
+}
+
+// messages of a gateway are handled in order by its own goroutine to not block the mqtt client
+func (this *MqttBridge) dispatch(client mqtt.Client, msg mqtt.Message) {
+	clientId, handler, ok := mqttTopicParts(msg.Topic())
+	if !ok {
+		log.Println("WARNING: ignore mqtt message on unexpected topic", msg.Topic())
+		return
+	}
+	this.mux.Lock()
+	gateway, ok := this.gateways[clientId]
+	if !ok && handler == "handshake" {
+		gateway = &mqttGateway{clientId: clientId, inbox: make(chan mqtt.Message, mqttInboxSize)}
+		this.gateways[clientId] = gateway
+		go this.serve(gateway)
+		ok = true
+	}
+	if ok {
+		select {
+		case gateway.inbox <- msg:
+		default:
+			log.Println("WARNING: drop mqtt message; inbox of client is full", clientId, handler)
+		}
+	}
+	this.mux.Unlock()
+	if !ok {
+		log.Println("WARNING: ignore mqtt message of client without handshake", clientId, handler)
+		go this.publish(this.topic(clientId, "response"), []byte(Message{Payload: "handshake required", Handler: "response", Status: 400}.Str()))
+	}
+}
+
+func (this *MqttBridge) serve(gateway *mqttGateway) {
+	idle := time.NewTimer(mqttIdleTimeout())
+	defer idle.Stop()
+	for {
+		select {
+		case <-idle.C:
+			this.mux.Lock()
+			delete(this.gateways, gateway.clientId)
+			this.mux.Unlock()
+			if session := gateway.getSession(); session != nil {
+				session.Close("idle timeout")
+			}
+			return
+		case msg := <-gateway.inbox:
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(mqttIdleTimeout())
+			_, handler, _ := mqttTopicParts(msg.Topic())
+			if handler == "handshake" {
+				this.handshake(gateway, msg.Payload())
+				continue
+			}
+			session := gateway.getSession()
+			if session == nil {
+				this.publish(this.topic(gateway.clientId, "response"), []byte(Message{Payload: "handshake required", Handler: "response", Status: 400}.Str()))
+				continue
+			}
+			if !gateway.authorized(session, msg.Payload()) {
+				log.Println("WARNING: drop mqtt message with invalid session secret", gateway.clientId, handler)
+				this.publish(this.topic(gateway.clientId, "response"), []byte(Message{Payload: "invalid session secret", Handler: "response", Status: 401}.Str()))
+				continue
+			}
+			session.traffic.addRawIn(len(msg.Payload()))
+			session.HandleMessageFor(handler, msg.Payload())
+		}
+	}
+}
+
+// a new handshake replaces the session of the client if it authenticates as the same user;
+// the session secret is published to {prefix}/{client}/out/session before the handshake response
+func (this *MqttBridge) handshake(gateway *mqttGateway, payload []byte) {
+	if ShuttingDown() {
+		this.publish(this.topic(gateway.clientId, "disconnect"), []byte(shutdownCloseReason))
+		return
+	}
+	cred, handshake, err := ParseHandshake(payload, JsonCodec, TransportAuth{})
+	if err != nil {
+		log.Println("mqtt handshake error", gateway.clientId, err)
+		this.publish(this.topic(gateway.clientId, "disconnect"), []byte("handshake error: "+err.Error()))
+		return
+	}
+	old := gateway.getSession()
+	if old != nil && old.Cred.User != cred.User {
+		log.Println("WARNING: ignore mqtt handshake of other user for existing session", gateway.clientId, cred.User)
+		return
+	}
+	codec, err := CodecByName(handshake.Encoding)
+	if err != nil {
+		log.Println("mqtt handshake error", gateway.clientId, err)
+		this.publish(this.topic(gateway.clientId, "disconnect"), []byte("handshake error: "+err.Error()))
+		return
+	}
+	if old != nil {
+		old.Close("new handshake")
+	}
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		log.Println("ERROR: unable to create mqtt session secret", gateway.clientId, err)
+		return
+	}
+	secret := hex.EncodeToString(random)
+	gateway.mux.Lock()
+	gateway.secret = sha256.Sum256([]byte(secret))
+	gateway.mux.Unlock()
+	err = this.publish(this.topic(gateway.clientId, "session"), []byte(Message{Payload: map[string]string{"session_secret": secret}, Handler: "session", Status: 200}.Str()))
+	if err != nil {
+		log.Println("ERROR: unable to publish mqtt session secret", gateway.clientId, err)
+		return
+	}
+	session, err := OpenSession(&mqttTransport{bridge: this, gateway: gateway, traffic: &trafficCounter{}}, cred, handshake, codec)
+	if err != nil {
+		log.Println("unable to open mqtt session", gateway.clientId, err)
+		return
+	}
+	gateway.mux.Lock()
+	gateway.session = session
+	gateway.mux.Unlock()
+}
+
+// checks the session secret of a request envelope
+func (this *mqttGateway) authorized(session *Session, payload []byte) bool {
+	envelope := mqttSessionEnvelope{}
+	if err := session.Codec().Unmarshal(payload, &envelope); err != nil {
+		return false
+	}
+	hash := sha256.Sum256([]byte(envelope.Session))
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return subtle.ConstantTimeCompare(hash[:], this.secret[:]) == 1
+}
+
+func (this *mqttGateway) getSession() *Session {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return this.session
+}
+
+type mqttTransport struct {
+	bridge  *MqttBridge
+	gateway *mqttGateway
+	traffic *trafficCounter
+}
+
+func (this *mqttTransport) Name() string {
+	return "mqtt"
+}
+
+func (this *mqttTransport) Write(msg outboundMessage) error {
+	if msg.msgType == websocket.CloseMessage {
+		return this.WriteControl(msg.msgType, msg.data)
+	}
+	name := "response"
+	if msg.handler == "command" {
+		name = "command"
+	}
+	return this.bridge.publish(this.bridge.topic(this.gateway.clientId, name), msg.data)
+}
+
+// close messages are published as plain reason to the disconnect topic; ping and pong are not used
+func (this *mqttTransport) WriteControl(msgType int, data []byte) error {
+	if msgType != websocket.CloseMessage {
+		return nil
+	}
+	reason := []byte{}
+	if len(data) > 2 {
+		reason = data[2:] //skip close code
+	}
+	return this.bridge.publish(this.bridge.topic(this.gateway.clientId, "disconnect"), reason)
+}
+
+// forgets the session; the gateway state is removed by the idle timeout
+func (this *mqttTransport) Close() error {
+	this.gateway.mux.Lock()
+	defer this.gateway.mux.Unlock()
+	if this.gateway.session != nil && this.gateway.session.transport == Transport(this) {
+		this.gateway.session = nil
+	}
+	return nil
+}
+
+func (this *mqttTransport) Traffic() *trafficCounter {
+	return this.traffic
+}
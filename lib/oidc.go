@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+// endpoints of an openid connect issuer, discovered with .well-known/openid-configuration
+type OidcProvider struct {
+	Realm         string `json:"-"`
+	Issuer        string `json:"issuer"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JwksUri       string `json:"jwks_uri"`
+	keys          *KeySet
+}
+
+const authRequestTimeout = 10 * time.Second
+const oidcDiscoveryRetryInterval = 10 * time.Second
+
+// used for discovery and jwks requests; a slow issuer must not block handshakes indefinitely
+var authClient = &http.Client{Timeout: authRequestTimeout}
+
+// discovery of a realm; concurrent callers wait for the same request, failures are kept for oidcDiscoveryRetryInterval
+type oidcDiscovery struct {
+	done     chan bool
+	provider *OidcProvider
+	err      error
+	finished time.Time
+}
+
+var oidcDiscoveries = map[string]*oidcDiscovery{}
+var oidcDiscoveriesMux sync.Mutex
+
+func DefaultRealm() string {
+	return util.Config.AuthRealm
+}
+
+// realms selectable with the handshake field realm
+func AllowedRealm(realm string) bool {
+	if realm == DefaultRealm() {
+		return true
+	}
+	for _, element := range util.Config.AuthRealms {
+		if element == realm {
+			return true
+		}
+	}
+	return false
+}
+
+// issuer url of a realm; config.AuthIssuerUrl may contain the placeholder {realm}
+func IssuerUrl(realm string) string {
+	issuer := util.Config.AuthIssuerUrl
+	if issuer == "" {
+		issuer = util.Config.AuthEndpoint + "/auth/realms/{realm}"
+	}
+	return strings.TrimSuffix(strings.Replace(issuer, "{realm}", realm, -1), "/")
+}
+
+// returns the discovered provider of the realm; the default realm is used if realm is empty
+func Provider(realm string) (provider *OidcProvider, err error) {
+	if realm == "" {
+		realm = DefaultRealm()
+	}
+	if !AllowedRealm(realm) {
+		return nil, errors.New("unknown realm '" + realm + "'")
+	}
+	oidcDiscoveriesMux.Lock()
+	discovery, ok := oidcDiscoveries[realm]
+	if ok && discovery.expired() {
+		ok = false
+	}
+	if ok {
+		oidcDiscoveriesMux.Unlock()
+		<-discovery.done
+		return discovery.provider, discovery.err
+	}
+	discovery = &oidcDiscovery{done: make(chan bool)}
+	oidcDiscoveries[realm] = discovery
+	oidcDiscoveriesMux.Unlock()
+
+	discovery.provider, discovery.err = discoverProvider(realm)
+	discovery.finished = time.Now()
+	close(discovery.done)
+	return discovery.provider, discovery.err
+}
+
+// failed discoveries are repeated after oidcDiscoveryRetryInterval; must be called with oidcDiscoveriesMux locked
+func (this *oidcDiscovery) expired() bool {
+	select {
+	case <-this.done:
+		return this.err != nil && time.Since(this.finished) > oidcDiscoveryRetryInterval
+	default:
+		return false
+	}
+}
+
+func discoverProvider(realm string) (provider *OidcProvider, err error) {
+	defer observeRepositoryCall("auth", "discovery", time.Now(), &err)
+	resp, err := authClient.Get(IssuerUrl(realm) + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected openid discovery response status " + resp.Status)
+	}
+	provider = &OidcProvider{}
+	err = json.NewDecoder(resp.Body).Decode(provider)
+	if err != nil {
+		return nil, err
+	}
+	if provider.TokenEndpoint == "" || provider.JwksUri == "" || provider.Issuer == "" {
+		return nil, errors.New("incomplete openid configuration of realm '" + realm + "'")
+	}
+	provider.Realm = realm
+	provider.keys = NewKeySet(provider.JwksUri)
+	return provider, nil
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const outboxDrainTimeout = 5 * time.Second
+
+var ErrOutboxClosed = errors.New("session is closed")
+
+var metricOutboxOverflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "connector_session_queue_overflows_total",
+	Help: "Number of outbound queue overflows by overflow policy.",
+}, []string{"policy"})
+
+func init() {
+	prometheus.MustRegister(
+		metricOutboxOverflows,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "connector_session_queue_depth",
+			Help: "Sum of queued outbound messages of all sessions.",
+		}, func() float64 {
+			sum, _ := outboxDepths()
+			return float64(sum)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "connector_session_queue_depth_max",
+			Help: "Highest number of queued outbound messages of a single session.",
+		}, func() float64 {
+			_, max := outboxDepths()
+			return float64(max)
+		}),
+	)
+}
+
+type outboundMessage struct {
+	msgType int
+	handler string //handler of the envelope; empty for close messages
+	data    []byte
+	prefix  string //device of a command
+	command string //raw command; reported as undeliverable if the message is dropped
+}
+
+// commands dropped from the outbound queue are reported as undeliverable; other messages are only logged
+func reportDroppedMessage(msg outboundMessage, reason string) {
+	if msg.command == "" {
+		return
+	}
+	command := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(msg.command), &command); err == nil {
+		//the error response replaces the timeout response
+		Commands().Resolve(CommandCorrelationId(command))
+	}
+	ReportUndeliverableCommand(msg.prefix, msg.command, UndeliverableSendFailure, reason)
+}
+
+func outboxDepths() (sum int, max int) {
+	if sessionsCollection == nil {
+		return 0, 0
+	}
+	for _, session := range sessionsCollection.List() {
+		depth := session.QueueDepth()
+		sum += depth
+		if depth > max {
+			max = depth
+		}
+	}
+	return
+}
+
+func newOutbox() chan outboundMessage {
+	size := util.Config.WsQueueSize
+	if size <= 0 {
+		size = 100
+	}
+	return make(chan outboundMessage, size)
+}
+
+func (session *Session) QueueDepth() int {
+	return len(session.outbox)
+}
+
+// adds the message to the outbound queue; on overflow config.WsQueueOverflow decides between drop_oldest, drop_newest and close
+func (session *Session) enqueue(msg outboundMessage) error {
+	session.outboxMux.Lock()
+	defer session.outboxMux.Unlock()
+	if session.outboxClosed {
+		return ErrOutboxClosed
+	}
+	select {
+	case session.outbox <- msg:
+		return nil
+	default:
+	}
+	policy := util.Config.WsQueueOverflow
+	metricOutboxOverflows.WithLabelValues(policy).Inc()
+	log.Println("WARNING: outbound queue overflow", session.Gateway, session.Id, policy)
+	switch policy {
+	case "drop_newest":
+		return errors.New("outbound queue is full; message dropped")
+	case "close":
+		go session.Close("outbound queue overflow")
+		return errors.New("outbound queue is full; session closed")
+	default:
+		//only this function sends to the outbox and it holds the lock; so a slot is free after dropping the oldest message
+		select {
+		case dropped := <-session.outbox:
+			//async because callers may hold the lock of the sessions collection
+			go reportDroppedMessage(dropped, "outbound queue overflow")
+		default:
+		}
+		session.outbox <- msg
+		return nil
+	}
+}
+
+func (session *Session) closeOutbox() {
+	session.outboxMux.Lock()
+	defer session.outboxMux.Unlock()
+	if !session.outboxClosed {
+		session.outboxClosed = true
+		close(session.outbox)
+	}
+}
+
+// waits until the writer has sent all queued messages or the timeout is reached;
+// messages still queued after the timeout fail once the transport is closed and are reported by writeLoop()
+func (session *Session) drainOutbox(timeout time.Duration) {
+	session.closeOutbox()
+	select {
+	case <-session.writerDone:
+	case <-time.After(timeout):
+		log.Println("WARNING: unable to send all queued messages to", session.Gateway, session.QueueDepth())
+	}
+}
+
+// single writer of the websocket; control messages are sent directly with WriteControl()
+func (session *Session) writeLoop() {
+	defer close(session.writerDone)
+	failed := false
+	for msg := range session.outbox {
+		if failed {
+			reportDroppedMessage(msg, "session closed before the message was sent")
+			continue
+		}
+		err := session.transport.Write(msg)
+		if err == nil {
+			session.traffic.addRawOut(len(msg.data))
+		}
+		if err == websocket.ErrCloseSent {
+			//the session is closing; the read loop closes the session when the gateway answers the close message
+			log.Println("WARNING: drop message after close message", session.Gateway, session.Id)
+			reportDroppedMessage(msg, "session closed before the message was sent")
+			continue
+		}
+		if err != nil {
+			log.Println("ERROR: unable to write to websocket", session.Gateway, session.Id, err)
+			reportDroppedMessage(msg, "write-error: "+err.Error())
+			failed = true
+			go session.Close("write-error: " + err.Error())
+		}
+	}
+}
+
+func (session *Session) writeControl(msgType int, data []byte) error {
+	return session.transport.WriteControl(msgType, data)
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+func TestOutboxOverflow(t *testing.T) {
+	cases := []struct {
+		policy     string
+		shouldFail bool
+		first      string //first queued message after the overflow
+		last       string //last queued message after the overflow
+	}{
+		{policy: "drop_oldest", shouldFail: false, first: "1", last: "overflow"},
+		{policy: "drop_newest", shouldFail: true, first: "0", last: "9"},
+		{policy: "close", shouldFail: true, first: "0", last: "9"},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			withConfig(t, func(config *util.ConfigStruct) {
+				config.WsQueueOverflow = c.policy
+			})
+			session := testSession()
+			session.closing = true //Close() needs the connection log
+			for i := 0; i < int(util.Config.WsQueueSize); i++ {
+				if err := session.SendResponse(Message{Handler: "response", Payload: strconv.Itoa(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := session.SendResponse(Message{Handler: "response", Payload: "overflow"})
+			if (err != nil) != c.shouldFail {
+				t.Fatal("unexpected result", err)
+			}
+			if session.QueueDepth() != int(util.Config.WsQueueSize) {
+				t.Fatal("unexpected queue depth", session.QueueDepth())
+			}
+			session.closeOutbox()
+			if err := session.SendResponse(Message{Handler: "response", Payload: "closed"}); err != ErrOutboxClosed {
+				t.Fatal("expected ErrOutboxClosed", err)
+			}
+			payloads := []string{}
+			for msg := range session.outbox {
+				decoded := Message{}
+				if err := json.Unmarshal(msg.data, &decoded); err != nil {
+					t.Fatal(err)
+				}
+				payloads = append(payloads, decoded.Payload.(string))
+			}
+			if payloads[0] != c.first || payloads[len(payloads)-1] != c.last {
+				t.Fatal("unexpected queued messages", payloads)
+			}
+		})
+	}
+}
+
+func TestDroppedCommandsAreReported(t *testing.T) {
+	deadLetters := subscribe(t, "dead_letters")
+
+	t.Run("drop_oldest", func(t *testing.T) {
+		withConfig(t, func(config *util.ConfigStruct) {
+			config.WsQueueOverflow = "drop_oldest"
+		})
+		session := testSession()
+		for i := 0; i <= int(util.Config.WsQueueSize); i++ {
+			if err := session.SendCommand("device_drop_oldest", `{"task_id": "`+strconv.Itoa(i)+`"}`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		letter := receiveDeadLetter(t, deadLetters, "device_drop_oldest")
+		if letter.Reason != UndeliverableSendFailure || letter.Command != `{"task_id": "0"}` {
+			t.Fatal("unexpected dead letter", letter)
+		}
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		session := testSession()
+		session.transport = &testTransport{err: errors.New("broken pipe")}
+		session.SendCommand("device_write_error", `{"task_id": "first"}`)
+		session.SendCommand("device_write_error", `{"task_id": "second"}`)
+		session.SendResponse(Message{Handler: "response", Payload: "not reported"})
+		session.closing = true //Close() needs the connection log
+		go session.writeLoop()
+		for _, task := range []string{"first", "second"} {
+			letter := receiveDeadLetter(t, deadLetters, "device_write_error")
+			if letter.Reason != UndeliverableSendFailure || letter.Command != `{"task_id": "`+task+`"}` {
+				t.Fatal("unexpected dead letter", letter)
+			}
+		}
+		session.closeOutbox()
+		<-session.writerDone
+		expectNoMessage(t, deadLetters)
+	})
+}
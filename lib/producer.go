@@ -17,54 +17,78 @@
 package lib
 
 import (
-	"github.com/SmartEnergyPlatform/platform-connector/util"
 	"log"
-	"time"
 
-	"sync"
+	"github.com/SmartEnergyPlatform/platform-connector/util"
 
 	"github.com/Shopify/sarama"
-	"github.com/wvanbergen/kazoo-go"
 )
 
-var onceProducer sync.Once
-var producer sarama.AsyncProducer
-
 func InitProducer() sarama.AsyncProducer {
-	var kz *kazoo.Kazoo
-	kz, err := kazoo.NewKazooFromConnectionString(util.Config.ZookeeperUrl, nil)
+	broker, err := KafkaBrokerList()
 	if err != nil {
-		log.Fatal("error in kazoo.NewKazooFromConnectionString()", err)
+		log.Fatal("error in KafkaBrokerList()", err)
 	}
-	broker, err := kz.BrokerList()
-	kz.Close()
-
+	conf, err := SaramaConfig()
 	if err != nil {
-		log.Fatal("error in kz.BrokerList()", err)
+		log.Fatal("error in SaramaConfig()", err)
 	}
-
-	sarama_conf := sarama.NewConfig()
-	sarama_conf.Version = sarama.V0_10_0_1
-	producer, err = sarama.NewAsyncProducer(broker, sarama_conf)
+	conf.Producer.Return.Successes = true
+	conf.Producer.Return.Errors = true
+	if util.Config.KafkaProducerRetries > 0 {
+		conf.Producer.Retry.Max = int(util.Config.KafkaProducerRetries)
+	}
+	producer, err := sarama.NewAsyncProducer(broker, conf)
 	if err != nil {
 		log.Fatal("error in sarama.NewAsyncProducer()", broker, err)
 	}
 	return producer
 }
 
-func Produce(topic string, message string) {
-	onceProducer.Do(func() {
-		producer = InitProducer()
-	})
+// key is used to select the partition; messages with the same key keep their order
+func Produce(topic string, key string, message string) error {
 	if message != "topic_init" {
-		log.Println("produce kafka msg: ", topic, message)
+		log.Println("produce kafka msg: ", topic, key, message)
+	}
+	err := Bus().Publish(BusMessage{Topic: topic, Key: key, Value: []byte(message)})
+	if err != nil {
+		metricKafkaProduceErrors.Inc()
+	} else {
+		metricKafkaProduced.Inc()
+	}
+	return err
+}
+
+func ProduceBatch(msgs []BusMessage) []error {
+	for _, msg := range msgs {
+		log.Println("produce kafka msg: ", msg.Topic, msg.Key, string(msg.Value))
+	}
+	errs := Bus().PublishBatch(msgs)
+	for _, err := range errs {
+		if err != nil {
+			metricKafkaProduceErrors.Inc()
+		} else {
+			metricKafkaProduced.Inc()
+		}
+	}
+	return errs
+}
+
+// key of event messages as configured by config.KafkaEventKey
+func EventKey(deviceId string, serviceId string) string {
+	switch util.Config.KafkaEventKey {
+	case "none":
+		return ""
+	case "device_service":
+		return deviceId + "." + serviceId
+	default:
+		return deviceId
 	}
-	producer.Input() <- &sarama.ProducerMessage{Topic: topic, Key: nil, Value: sarama.StringEncoder(message), Timestamp: time.Now()}
 }
 
 func CloseProducer() {
-	onceProducer.Do(func() {
-		producer = InitProducer()
-	})
-	producer.Close()
+	err := Bus().Close()
+	if err != nil {
+		log.Println("ERROR: while closing message bus", err)
+	}
 }
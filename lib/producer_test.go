@@ -0,0 +1,43 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"testing"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+func TestEventKey(t *testing.T) {
+	cases := []struct {
+		setting  string
+		expected string
+	}{
+		{setting: "device", expected: "device"},
+		{setting: "device_service", expected: "device.service"},
+		{setting: "none", expected: ""},
+		{setting: "", expected: "device"},
+	}
+	for _, c := range cases {
+		withConfig(t, func(config *util.ConfigStruct) {
+			config.KafkaEventKey = c.setting
+		})
+		if key := EventKey("device", "service"); key != c.expected {
+			t.Fatal("unexpected key for KafkaEventKey", c.setting, key)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"sort"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+const LegacyProtocolVersion = 1 //handshake without protocol_version
+const CurrentProtocolVersion = 2
+
+// handlers added by each protocol version; a version supports all handlers of the previous versions
+var protocolHandlers = map[int]map[string]MessageHandlerFunction{
+	1: MessageHandler,
+	2: {
+		"events": events,
+	},
+}
+
+// returns the protocol version used for a session; unknown newer versions are downgraded to CurrentProtocolVersion
+func NegotiateProtocolVersion(requested int) int {
+	if requested < LegacyProtocolVersion {
+		return LegacyProtocolVersion
+	}
+	if requested > CurrentProtocolVersion {
+		return CurrentProtocolVersion
+	}
+	return requested
+}
+
+func HandlerFor(version int, name string) (handler MessageHandlerFunction, ok bool) {
+	for v := version; v >= LegacyProtocolVersion; v-- {
+		if handler, ok = protocolHandlers[v][name]; ok {
+			return
+		}
+	}
+	return
+}
+
+func HandlerNames(version int) (result []string) {
+	for v := LegacyProtocolVersion; v <= version; v++ {
+		for name := range protocolHandlers[v] {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return
+}
+
+// features of this connector instance announced in the handshake response
+func ServerCapabilities() (result []string) {
+	result = []string{"event_time", "token_auth"}
+	for _, codec := range codecs {
+		result = append(result, "encoding:"+codec.Name())
+	}
+	if util.Config.EventDedupWindow > 0 {
+		result = append(result, "event_dedup")
+	}
+	if util.Config.CommandTimeout > 0 {
+		result = append(result, "command_timeout")
+	}
+	if CommandBufferEnabled() {
+		result = append(result, "command_buffer")
+	}
+	if WsCompressionEnabled() {
+		result = append(result, "compression")
+	}
+	if ClientCertificatesEnabled() {
+		result = append(result, "client_certificate")
+	}
+	return
+}
+
+// legacy gateways only receive gid and hash
+func handshakeResponse(session *Session, hash string) interface{} {
+	if session.ProtocolVersion < 2 {
+		return map[string]string{"gid": session.Gateway, "hash": hash}
+	}
+	return map[string]interface{}{
+		"gid":              session.Gateway,
+		"hash":             hash,
+		"protocol_version": session.ProtocolVersion,
+		"capabilities":     ServerCapabilities(),
+		"handlers":         HandlerNames(session.ProtocolVersion),
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"testing"
+)
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	cases := []struct {
+		requested int
+		expected  int
+	}{
+		{requested: 0, expected: LegacyProtocolVersion},
+		{requested: -1, expected: LegacyProtocolVersion},
+		{requested: 1, expected: 1},
+		{requested: 2, expected: 2},
+		{requested: CurrentProtocolVersion + 1, expected: CurrentProtocolVersion},
+	}
+	for _, c := range cases {
+		if version := NegotiateProtocolVersion(c.requested); version != c.expected {
+			t.Fatal("unexpected version for", c.requested, version)
+		}
+	}
+}
+
+func TestHandlerFor(t *testing.T) {
+	cases := []struct {
+		version int
+		handler string
+		ok      bool
+	}{
+		{version: 1, handler: "event", ok: true},
+		{version: 1, handler: "events", ok: false},
+		{version: 2, handler: "event", ok: true},
+		{version: 2, handler: "events", ok: true},
+		{version: 2, handler: "unknown", ok: false},
+	}
+	for _, c := range cases {
+		if _, ok := HandlerFor(c.version, c.handler); ok != c.ok {
+			t.Fatal("unexpected result for", c.version, c.handler, ok)
+		}
+	}
+}
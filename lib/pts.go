@@ -23,9 +23,11 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 func RegisterPts(device string) (err error) {
+	defer observeRepositoryCall("pts", "RegisterPts", time.Now(), &err)
 	resp, err := http.Post(util.Config.PtsUrl+"/add/route/"+util.Config.KafkaSourceTopic+"/"+url.QueryEscape(device)+"/"+url.QueryEscape("*")+"/"+util.Config.KafkaConsumerTopic, "", nil)
 
 	if err != nil {
@@ -45,6 +47,7 @@ func RegisterPts(device string) (err error) {
 }
 
 func DeregisterPts(device string) (err error) {
+	defer observeRepositoryCall("pts", "DeregisterPts", time.Now(), &err)
 	req, err := http.NewRequest("DELETE", util.Config.PtsUrl+"/remove/route/"+util.Config.KafkaSourceTopic+"/"+url.QueryEscape(device)+"/"+url.QueryEscape("*")+"/"+util.Config.KafkaConsumerTopic, nil)
 	if err != nil {
 		log.Println("error while building DeregisterPts() request: ", err)
@@ -69,6 +72,7 @@ func DeregisterPts(device string) (err error) {
 }
 
 func ClearPts() (err error) {
+	defer observeRepositoryCall("pts", "ClearPts", time.Now(), &err)
 	req, err := http.NewRequest("DELETE", util.Config.PtsUrl+"/remove/target/"+util.Config.KafkaConsumerTopic, nil)
 	if err != nil {
 		log.Println("error while building DeregisterPts() request: ", err)
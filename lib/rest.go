@@ -0,0 +1,242 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/model"
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/SmartEnergyPlatform/formatter-lib"
+)
+
+// authenticated gateway state reused by http requests with the same credentials and gateway
+type restSession struct {
+	mux     sync.Mutex //serializes requests; the formatter cache of a session is not thread safe
+	session *Session
+	created time.Time
+}
+
+type RestSessions struct {
+	mux      sync.Mutex
+	sessions map[string]*restSession //realm + "/" + user + "/" + gateway id + "/" + hash of password or token -> session
+}
+
+var restSessions = &RestSessions{sessions: map[string]*restSession{}}
+
+func RestIngressEnabled() bool {
+	return util.Config.RestIngress == "true"
+}
+
+func restSessionTtl() time.Duration {
+	if util.Config.RestSessionTtl > 0 {
+		return time.Duration(util.Config.RestSessionTtl) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// returns a cached session for the credentials, otherwise the credentials are authenticated and a new session is created;
+// secret is the password or token of the credentials
+func (this *RestSessions) Get(cred *Credentials, secret string) (result *restSession, status int, err error) {
+	gatewayId := cred.Gateway
+	secretHash := sha256.Sum256([]byte(secret))
+	key := cred.Realm + "/" + cred.User + "/" + gatewayId + "/" + hex.EncodeToString(secretHash[:])
+	this.mux.Lock()
+	for k, cached := range this.sessions {
+		if time.Since(cached.created) > restSessionTtl() {
+			delete(this.sessions, k)
+		}
+	}
+	cached, ok := this.sessions[key]
+	this.mux.Unlock()
+	if ok {
+		return cached, http.StatusOK, nil
+	}
+
+	err = cred.Authenticate()
+	if err != nil {
+		log.Println("ERROR: RestSessions::Authenticate", err)
+		return nil, http.StatusUnauthorized, errors.New("authentication error")
+	}
+	gateway, err := GetGateway(gatewayId, cred)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	if gateway.Id != gatewayId {
+		return nil, http.StatusNotFound, errors.New("unknown gateway")
+	}
+	session := &Session{
+		Cred:                       cred,
+		Gateway:                    gateway.Id,
+		UriCache:                   map[string]model.DeviceServiceEntity{},
+		eventTransformerCollection: map[string]formatter_lib.EventTransformer{},
+		traffic:                    &trafficCounter{},
+		ConnectTime:                time.Now(),
+		ProtocolVersion:            CurrentProtocolVersion,
+	}
+	cache := &map[string]model.ShortDeviceType{}
+	for _, device := range gateway.Devices {
+		entity, err := DeviceInstanceToDeviceServiceEntity(device, cache, cred)
+		if err != nil {
+			return nil, http.StatusBadGateway, err
+		}
+		session.UriCache[entity.Device.Url] = entity
+	}
+	result = &restSession{session: session, created: time.Now()}
+	this.mux.Lock()
+	this.sessions[key] = result
+	this.mux.Unlock()
+	return result, http.StatusOK, nil
+}
+
+// resolves devices that were added to the gateway after the session was cached
+func (this *restSession) resolveDevice(uri string) (status int, err error) {
+	if _, err = this.session.GetEntity(uri); err == nil {
+		return http.StatusOK, nil
+	}
+	entities, err := DeviceUrlToIotDevice(uri, this.session.Cred)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	for _, entity := range entities {
+		if entity.Device.Gateway == this.session.Gateway {
+			this.session.Mux.Lock()
+			this.session.UriCache[uri] = entity
+			this.session.Mux.Unlock()
+			return http.StatusOK, nil
+		}
+	}
+	return http.StatusNotFound, errors.New("device '" + uri + "' is not connected to gateway " + this.session.Gateway)
+}
+
+// POST /gateways/{gateway_id}/devices/{device_uri}/services/{service_uri}/events
+func gatewayHttpHandler(w http.ResponseWriter, r *http.Request) {
+	if ShuttingDown() {
+		http.Error(w, shutdownCloseReason, http.StatusServiceUnavailable)
+		return
+	}
+	activeHandlers.Add(1)
+	defer activeHandlers.Done()
+	parts, err := pathParts(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(parts) < 2 || parts[0] != "gateways" {
+		http.NotFound(w, r)
+		return
+	}
+	cred, secret, ok := requestCredentials(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="connector"`)
+		http.Error(w, "access denied", http.StatusUnauthorized)
+		return
+	}
+	cred.Gateway = parts[1]
+	if cert := clientCertificate(r); cert != nil {
+		err := cred.useCertificate(cert)
+		if err != nil {
+			log.Println("ERROR: gatewayHttpHandler::useCertificate", err)
+			http.Error(w, "access denied", http.StatusUnauthorized)
+			return
+		}
+	}
+	switch {
+	case len(parts) == 7 && parts[2] == "devices" && parts[4] == "services" && parts[6] == "events" && r.Method == http.MethodPost:
+		rest, status, err := restSessions.Get(cred, secret)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		restEvents(w, r, rest, parts[3], parts[5])
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// client certificate, basic auth or bearer token; the realm is selected by the optional query parameter realm
+func requestCredentials(r *http.Request) (cred *Credentials, secret string, ok bool) {
+	realm := r.URL.Query().Get("realm")
+	if cert := clientCertificate(r); cert != nil {
+		//realm and user are set by useCertificate()
+		return &Credentials{}, string(cert.Raw), true
+	}
+	if token := bearerToken(r); token != "" {
+		return &Credentials{AccessToken: token, Realm: realm}, token, true
+	}
+	user, pw, ok := r.BasicAuth()
+	return &Credentials{User: user, Pw: pw, Realm: realm}, pw, ok
+}
+
+// the body is a single event or a list of events of the device service:
+// {"value": <<protocol_parts>>, "time": "<<rfc3339>>", "message_id": "<<id>>"}
+func restEvents(w http.ResponseWriter, r *http.Request, rest *restSession, deviceUri string, serviceUri string) {
+	rest.mux.Lock()
+	defer rest.mux.Unlock()
+	raw := json.RawMessage{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, httpMaxBodySize())).Decode(&raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	batch := bytes.HasPrefix(bytes.TrimSpace(raw), []byte("["))
+	events := []model.EventMessage{}
+	if batch {
+		err = json.Unmarshal(raw, &events)
+	} else {
+		event := model.EventMessage{}
+		err = json.Unmarshal(raw, &event)
+		events = append(events, event)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if util.Config.MaxEventBatchSize > 0 && int64(len(events)) > util.Config.MaxEventBatchSize {
+		http.Error(w, "too many events in batch; max "+strconv.FormatInt(util.Config.MaxEventBatchSize, 10), http.StatusBadRequest)
+		return
+	}
+	status, err := rest.resolveDevice(deviceUri)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	for i := range events {
+		events[i].DeviceUri = deviceUri
+		events[i].ServiceUri = serviceUri
+	}
+	result := produceEvents(rest.session, events)
+	if batch {
+		writeJson(w, result)
+		return
+	}
+	if result[0].Status != http.StatusOK {
+		http.Error(w, result[0].Error, result[0].Status)
+		return
+	}
+	writeJson(w, "ok")
+}
@@ -18,21 +18,97 @@ package lib
 
 import (
 	"bytes"
+	"crypto/x509"
 	"github.com/SmartEnergyPlatform/platform-connector/util"
 	"errors"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type Credentials struct {
 	User         string          `json:"user"`
 	Pw           string          `json:"pw"`
-	Token        string          `json:"token"` //responsetoken if needed
+	AccessToken  string          `json:"access_token,omitempty"`  //alternative to user and pw
+	RefreshToken string          `json:"refresh_token,omitempty"` //alternative to user and pw
+	Realm        string          `json:"realm,omitempty"`         //config.AuthRealm if empty
+	Token        string          `json:"token"`                   //responsetoken if needed
 	Gateway      string          `json:"gid"`
 	Openid       *OpenidToken    `json:"-"`
 	ErrorHandler func(err error) `json:"-"`
+	certificate  *CertificateIdentity
+}
+
+// authentication presented by the transport besides the handshake
+type TransportAuth struct {
+	Bearer      string            //token of an "Authorization: Bearer" header
+	Certificate *x509.Certificate //verified client certificate
+}
+
+func transportAuth(r *http.Request) TransportAuth {
+	return TransportAuth{Bearer: bearerToken(r), Certificate: clientCertificate(r)}
+}
+
+// returns the token of an "Authorization: Bearer <<token>>" header
+func bearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+func PasswordGrantEnabled() bool {
+	return util.Config.AuthPasswordGrant == "true"
+}
+
+// authenticates a handshake; presented tokens are validated locally, user and pw use the legacy password grant
+func (this *Credentials) Authenticate() (err error) {
+	if this.Realm != "" && !AllowedRealm(this.Realm) {
+		return errors.New("unknown realm '" + this.Realm + "'")
+	}
+	if this.certificate != nil {
+		return this.EnsureAccess()
+	}
+	if this.AccessToken == "" && this.RefreshToken == "" {
+		if !PasswordGrantEnabled() {
+			return errors.New("password authentication is disabled; use access_token or refresh_token")
+		}
+		return this.EnsureAccess()
+	}
+	this.Pw = "" //a token session must not fall back to the password grant
+	this.Openid = &OpenidToken{AccessToken: this.AccessToken, RefreshToken: this.RefreshToken, TokenType: "bearer", RequestTime: time.Now()}
+	this.AccessToken = ""
+	this.RefreshToken = ""
+	if exp, ok := unverifiedExpiration(this.Openid.RefreshToken); ok {
+		this.Openid.RefreshExpiresIn = time.Until(exp).Seconds()
+	}
+	if this.Openid.AccessToken == "" {
+		err = RefreshOpenidToken(this.Realm, this.Openid)
+		if err != nil {
+			metricTokenFailures.WithLabelValues("refresh_token").Inc()
+			return err
+		}
+	}
+	claims, err := ValidateAccessToken(this.Realm, this.Openid.AccessToken)
+	if err != nil {
+		metricTokenFailures.WithLabelValues("access_token").Inc()
+		return err
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		this.Openid.ExpiresIn = time.Until(time.Unix(int64(exp), 0)).Seconds()
+	}
+	user, _ := claims["preferred_username"].(string)
+	if user == "" {
+		user, _ = claims["sub"].(string)
+	}
+	if user == "" {
+		return errors.New("token without user")
+	}
+	this.User = user
+	return nil
 }
 
 func (this *Credentials) EnsureAccess() (err error) {
@@ -51,19 +127,36 @@ func (this *Credentials) EnsureAccess() (err error) {
 		return
 	}
 
-	if this.Openid.RefreshToken != "" && this.Openid.RefreshExpiresIn-util.Config.AuthExpirationTimeBuffer < duration {
+	//a refresh_expires_in of 0 is used for refresh tokens without expiration (offline tokens)
+	if this.Openid.RefreshToken != "" && (this.Openid.RefreshExpiresIn == 0 || this.Openid.RefreshExpiresIn-util.Config.AuthExpirationTimeBuffer > duration) {
 		log.Println("refresh token", this.Openid.RefreshExpiresIn, duration)
-		err = RefreshOpenidToken(this.Openid)
+		err = RefreshOpenidToken(this.Realm, this.Openid)
 		if err != nil {
+			metricTokenFailures.WithLabelValues("refresh_token").Inc()
 			log.Println("WARNING: unable to use refreshtoken", err)
 		} else {
 			return
 		}
 	}
 
+	if this.certificate != nil {
+		log.Println("get new access token for client certificate")
+		err = this.certificateAccess()
+		if err != nil {
+			log.Println("ERROR: unable to get new access token for client certificate", err)
+			this.Openid = &OpenidToken{}
+		}
+		return
+	}
+
+	if this.Pw == "" {
+		err = errors.New("token expired")
+		return
+	}
 	log.Println("get new access token")
-	err = GetOpenidToken(this.User, this.Pw, this.Openid)
+	err = GetOpenidToken(this.Realm, this.User, this.Pw, this.Openid)
 	if err != nil {
+		metricTokenFailures.WithLabelValues("password").Inc()
 		log.Println("ERROR: unable to get new access token", err)
 		this.Openid = &OpenidToken{}
 	}
@@ -33,6 +33,10 @@ import (
 
 	"net"
 
+	"net/http"
+
+	"strconv"
+
 	"github.com/gorilla/websocket"
 	"github.com/satori/go.uuid"
 )
@@ -41,8 +45,14 @@ type Session struct {
 	Id                         string
 	Prefixes                   []string
 	Cred                       *Credentials
-	ws                         *websocket.Conn
-	wsMux                      sync.Mutex
+	ws                         *websocket.Conn //nil for sessions of other transports
+	transport                  Transport
+	codec                      Codec
+	traffic                    *trafficCounter
+	outbox                     chan outboundMessage
+	outboxMux                  sync.Mutex
+	outboxClosed               bool
+	writerDone                 chan bool
 	stopPing                   chan bool
 	Mux                        sync.Mutex
 	UriCache                   map[string]model.DeviceServiceEntity
@@ -51,9 +61,14 @@ type Session struct {
 	Gateway                    string
 	closing                    bool
 	activePing                 bool
+	ConnectTime                time.Time
+	ProtocolVersion            int
+	Capabilities               []string          //announced by the gateway in the handshake; informational only
+	opening                    bool              //until the handshake response is queued; guarded by the lock of the sessions collection
+	held                       []bufferedCommand //commands held while opening; guarded by the lock of the sessions collection
 }
 
-func NewSession(connection *websocket.Conn) {
+func NewSession(connection *websocket.Conn, request *http.Request) {
 	connection.SetPongHandler(func(msg string) error {
 		err := connection.SetReadDeadline(time.Now().Add(time.Second * time.Duration(util.Config.WsTimeout)))
 		if err != nil {
@@ -62,46 +77,32 @@ func NewSession(connection *websocket.Conn) {
 		return nil
 	})
 
-	cred, err := WsHandshake(connection)
+	codec, err := CodecByName(connection.Subprotocol())
 	if err != nil {
 		log.Println("handshake error", err)
 		connection.Close()
 		return
 	}
-	gateway, err := GetGateway(cred.Gateway, cred)
+	cred, handshake, err := WsHandshake(connection, codec, transportAuth(request))
 	if err != nil {
-		log.Println("error while geting gateway", err)
+		log.Println("handshake error", err)
 		connection.Close()
 		return
 	}
-	if gateway.Id == "" {
-		log.Println("gateway error", err)
-		connection.Close()
-		return
+	if connection.Subprotocol() == "" && handshake.Encoding != "" {
+		codec, err = CodecByName(handshake.Encoding)
+		if err != nil {
+			log.Println("handshake error", err)
+			connection.Close()
+			return
+		}
 	}
-	uuid := uuid.NewV4()
+	session, err := OpenSession(newWsTransport(connection), cred, handshake, codec)
 	if err != nil {
-		connection.Close()
+		log.Println("unable to open session", err)
 		return
 	}
-	session := Session{
-		Id:                         uuid.String(),
-		Cred:                       cred,
-		ws:                         connection,
-		UriCache:                   map[string]model.DeviceServiceEntity{},
-		eventTransformerCollection: map[string]formatter_lib.EventTransformer{},
-		ConsecutiveErrors:          0,
-		closing:                    false,
-		Gateway:                    gateway.Id,
-		stopPing:                   make(chan bool),
-		activePing:                 true,
-	}
-
-	Sessions().Register(&session)
-
-	cred.ErrorHandler = func(err error) {
-		session.Close("auth error: " + err.Error())
-	}
+	session.ws = connection
 
 	connection.SetPingHandler(func(msg string) error {
 		connection.SetReadDeadline(time.Now().Add(time.Second * time.Duration(util.Config.WsTimeout)))
@@ -123,23 +124,71 @@ func NewSession(connection *websocket.Conn) {
 		return nil
 	})
 
+	session.Start()
+}
+
+// creates and registers the session of an authenticated gateway, restores its devices and sends the handshake response;
+// the transport is closed on error
+func OpenSession(transport Transport, cred *Credentials, handshake Handshake, codec Codec) (*Session, error) {
+	gateway, err := GetGateway(cred.Gateway, cred)
+	if err != nil {
+		log.Println("error while geting gateway", err)
+		transport.Close()
+		return nil, err
+	}
+	if gateway.Id == "" {
+		log.Println("gateway error", err)
+		transport.Close()
+		return nil, errors.New("gateway error")
+	}
+	uuid := uuid.NewV4()
+	session := &Session{
+		Id:                         uuid.String(),
+		Cred:                       cred,
+		transport:                  transport,
+		codec:                      codec,
+		traffic:                    transport.Traffic(),
+		UriCache:                   map[string]model.DeviceServiceEntity{},
+		eventTransformerCollection: map[string]formatter_lib.EventTransformer{},
+		ConsecutiveErrors:          0,
+		closing:                    false,
+		Gateway:                    gateway.Id,
+		stopPing:                   make(chan bool),
+		activePing:                 true,
+		ConnectTime:                time.Now(),
+		ProtocolVersion:            NegotiateProtocolVersion(handshake.ProtocolVersion),
+		Capabilities:               handshake.Capabilities,
+		outbox:                     newOutbox(),
+		writerDone:                 make(chan bool),
+		opening:                    true,
+	}
+	go session.writeLoop()
+
+	Sessions().Register(session)
+
+	cred.ErrorHandler = func(err error) {
+		session.Close("auth error: " + err.Error())
+	}
+
 	cache := &map[string]model.ShortDeviceType{}
 	for _, device := range gateway.Devices {
 		entity, err := DeviceInstanceToDeviceServiceEntity(device, cache, session.Cred)
 		if err != nil {
 			session.Close("ERROR while creating device-service-entity: " + err.Error())
-			return
+			return nil, err
 		}
 		err = session.ListenToEntity(entity)
 		if err != nil {
 			session.Close("ERROR: while trying to listen to device-service-entity: " + err.Error())
-			return
+			return nil, err
 		}
 	}
 
-	session.SendResponse(Message{Payload: map[string]string{"gid": gateway.Id, "hash": gateway.Hash}, Token: cred.Token, Status: 200, Handler: "response"})
+	session.SendResponse(Message{Payload: handshakeResponse(session, gateway.Hash), Token: cred.Token, Status: 200, Handler: "response"})
+	//buffered and new commands are held until the handshake response is queued
+	Sessions().Opened(session)
 	session.LogGatewayConnect()
-	session.Start()
+	return session, nil
 }
 
 func (session *Session) Start() {
@@ -163,32 +212,55 @@ func (session *Session) Start() {
 				closeMsg = "read-error: " + err.Error() + "\nmsg: " + string(buff)
 				return
 			}
-			if msgtype == websocket.TextMessage {
-				session.HandleMessage(string(buff))
+			session.traffic.addRawIn(len(buff))
+			if msgtype == session.codec.FrameType() {
+				session.HandleMessage(buff)
+			} else {
+				log.Println("WARNING: ignore message with unexpected frame type", msgtype, session.Id)
 			}
 		}
 	}()
 }
 
-func (session *Session) HandleMessage(message string) {
+func (session *Session) HandleMessage(message []byte) {
+	session.HandleMessageFor("", message)
+}
+
+// handles a message; a non-empty handler replaces the handler of the envelope (used by transports with handler specific topics)
+func (session *Session) HandleMessageFor(handler string, message []byte) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Println("ERROR: Recovered in HandleMessage", r)
 		}
 	}()
-	log.Println("handle message: ", session.Cred.User, session.Id, message)
+	log.Println("handle message: ", session.Cred.User, session.Id, session.describeFrame(message))
 
+	activeHandlers.Add(1)
+	defer activeHandlers.Done()
+
+	start := time.Now()
 	request, err := session.NewRequest(message)
+	if handler != "" {
+		request.Handler = handler
+	}
+	defer func() {
+		observeHandler(request.Handler, start)
+	}()
 
 	if err != nil {
-		session.SendError(Message{Payload: "unable to parse request from message (" + message + ")", Token: "", Handler: "response", Status: 400})
+		session.SendError(Message{Payload: "unable to parse request from message (" + session.describeFrame(message) + ")", Token: "", Handler: "response", Status: 400})
+	}
+
+	if ShuttingDown() {
+		session.SendError(Message{Payload: shutdownCloseReason, Token: request.Token, Handler: "response", Status: 503})
+		return
 	}
 
-	if handler, ok := MessageHandler[request.Handler]; ok {
+	if handler, ok := HandlerFor(session.ProtocolVersion, request.Handler); ok {
 		handler(session, request)
 	} else {
 		log.Println("unknown handler: ", request)
-		session.SendError(Message{Payload: "unknown handler in request (" + message + ")", Token: request.Token, Handler: "response", Status: 400})
+		session.SendError(Message{Payload: "unknown handler in request (" + session.describeFrame(message) + ")", Token: request.Token, Handler: "response", Status: 400})
 	}
 }
 
@@ -216,21 +288,37 @@ func (session *Session) startPing() {
 }
 
 func (session *Session) Close(reason string) {
-	log.Println("close connection to gateway: ", session.Gateway, "; is already closing: ", session.closing)
-	if !session.closing {
-		session.closing = true
+	session.closeWithin(reason, outboxDrainTimeout)
+}
+
+// drainTimeout limits the time spent to send queued messages before the close message
+func (session *Session) closeWithin(reason string, drainTimeout time.Duration) {
+	session.Mux.Lock()
+	closing := session.closing
+	session.closing = true
+	session.Mux.Unlock()
+	log.Println("close connection to gateway: ", session.Gateway, "; is already closing: ", closing)
+	if !closing {
+		session.drainOutbox(drainTimeout)
 		log.Println("send closing msg to ", session.Gateway, session.SendClose(reason))
-		log.Println("close websocket to", session.Gateway, session.ws.Close())
+		log.Println("close", session.transport.Name(), "to", session.Gateway, session.transport.Close())
 		session.LogDisconnect()
 		Sessions().Deregister(session)
-		//non-blocking-channel-send to stop ping ticker
-		select {
-		case session.stopPing <- true:
-		}
+		//closing instead of sending to not block if the ping loop itself closes the session
+		close(session.stopPing)
 	}
 }
 
-func WsHandshake(conn *websocket.Conn) (credentials *Credentials, err error) {
+// optional handshake fields besides the credentials
+type Handshake struct {
+	Encoding        string   `json:"encoding,omitempty"`         //json (default), msgpack or cbor; ignored if negotiated as websocket subprotocol
+	ProtocolVersion int      `json:"protocol_version,omitempty"` //LegacyProtocolVersion if missing
+	Capabilities    []string `json:"capabilities,omitempty"`
+}
+
+// the handshake is encoded with the codec negotiated as websocket subprotocol (json if none);
+// a bearer token of the upgrade request is used if the handshake contains no token
+func WsHandshake(conn *websocket.Conn, codec Codec, auth TransportAuth) (credentials *Credentials, handshake Handshake, err error) {
 	credentials = &Credentials{}
 	err = conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(util.Config.WsTimeout)))
 	if err != nil {
@@ -240,14 +328,35 @@ func WsHandshake(conn *websocket.Conn) (credentials *Credentials, err error) {
 	if err != nil {
 		return
 	}
-	log.Println("debug: handshake: ", msgType, string(msg))
-	err = json.Unmarshal(msg, credentials)
+	log.Println("debug: handshake: ", msgType, codec.Name(), len(msg))
+	return ParseHandshake(msg, codec, auth)
+}
+
+// decodes the handshake message and authenticates the credentials;
+// a client certificate of the transport takes precedence over the credentials of the handshake
+func ParseHandshake(msg []byte, codec Codec, auth TransportAuth) (credentials *Credentials, handshake Handshake, err error) {
+	credentials = &Credentials{}
+	err = codec.Unmarshal(msg, credentials)
 	if err != nil {
 		return
 	}
-	err = credentials.EnsureAccess()
+	err = codec.Unmarshal(msg, &handshake)
 	if err != nil {
-		log.Println("ERROR: WsHandshake::EnsureAccess", err)
+		return
+	}
+	if auth.Certificate != nil {
+		err = credentials.useCertificate(auth.Certificate)
+		if err != nil {
+			log.Println("ERROR: ParseHandshake::useCertificate", err)
+			err = errors.New("authentication error")
+			return
+		}
+	} else if auth.Bearer != "" && credentials.AccessToken == "" && credentials.RefreshToken == "" {
+		credentials.AccessToken = auth.Bearer
+	}
+	err = credentials.Authenticate()
+	if err != nil {
+		log.Println("ERROR: ParseHandshake::Authenticate", err)
 		err = errors.New("authentication error")
 	}
 	return
@@ -255,13 +364,14 @@ func WsHandshake(conn *websocket.Conn) (credentials *Credentials, err error) {
 
 func (session *Session) SendResponse(response Message) error {
 	session.ConsecutiveErrors = 0
-	return session.SendWsMsg(websocket.TextMessage, response.Str())
+	return session.SendMessage(response)
 
 }
 
 func (session *Session) SendError(response Message) (err error) {
+	observeErrorResponse(response.Status)
 	session.ConsecutiveErrors++
-	err = session.SendWsMsg(websocket.TextMessage, response.Str())
+	err = session.SendMessage(response)
 	if session.ConsecutiveErrors > util.Config.MaxConsecutiveErrors && util.Config.MaxConsecutiveErrors >= 0 {
 		session.Close("ERROR: max consecutive error count exceeded")
 		return err
@@ -270,18 +380,58 @@ func (session *Session) SendError(response Message) (err error) {
 }
 
 func (session *Session) SendClose(reason string) (err error) {
-	session.wsMux.Lock()
-	defer session.wsMux.Unlock()
-	return session.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+	return session.SendCloseCode(websocket.CloseNormalClosure, reason)
+}
+
+// the close message is queued behind pending messages; if the queue is already closed it is sent directly
+func (session *Session) SendCloseCode(code int, reason string) (err error) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	err = session.enqueue(outboundMessage{msgType: websocket.CloseMessage, data: msg})
+	if err == ErrOutboxClosed {
+		err = session.writeControl(websocket.CloseMessage, msg)
+	}
+	return err
+}
+
+// encodes the message with the codec of the session
+func (session *Session) SendMessage(msg Message) (err error) {
+	return session.sendMessage(msg, "", "")
+}
+
+// prefix and command are set for commands to report them if they are dropped from the outbound queue
+func (session *Session) sendMessage(msg Message, prefix string, command string) (err error) {
+	data, err := msg.Encode(session.Codec())
+	if err != nil {
+		log.Println("ERROR: unable to encode message", err)
+		return err
+	}
+	log.Println("send msg to ws: ", session.Cred.User, session.Id, session.describeFrame(data))
+	return session.enqueue(outboundMessage{msgType: session.Codec().FrameType(), handler: msg.Handler, data: data, prefix: prefix, command: command})
+}
+
+func (session *Session) Codec() Codec {
+	if session.codec == nil {
+		return JsonCodec
+	}
+	return session.codec
+}
+
+// returns a loggable representation of a message in the encoding of the session
+func (session *Session) describeFrame(message []byte) string {
+	if session.Codec().FrameType() == websocket.TextMessage {
+		return string(message)
+	}
+	return strconv.Itoa(len(message)) + " bytes " + session.Codec().Name()
 }
 
 func (session *Session) SendWsMsg(msgType int, msg string) (err error) {
 	if msgType != websocket.PingMessage && msgType != websocket.PongMessage {
 		log.Println("send msg to ws: ", session.Cred.User, session.Id, msg)
 	}
-	session.wsMux.Lock()
-	defer session.wsMux.Unlock()
-	return session.ws.WriteMessage(msgType, []byte(msg))
+	if msgType == websocket.PingMessage || msgType == websocket.PongMessage {
+		return session.writeControl(msgType, []byte(msg))
+	}
+	return session.enqueue(outboundMessage{msgType: msgType, data: []byte(msg)})
 }
 
 func (session *Session) GetFormater(cred *Credentials, deviceid string, serviceid string) (transformer formatter_lib.EventTransformer, err error) {
@@ -364,12 +514,12 @@ func (session *Session) GetEntity(uri string) (entity model.DeviceServiceEntity,
 	return
 }
 
-func (session *Session) SendCommand(msg string) (err error) {
+func (session *Session) SendCommand(prefix string, msg string) (err error) {
 	var parsedMsg interface{}
 	err = json.Unmarshal([]byte(msg), &parsedMsg)
 	if err != nil {
 		log.Println("ERROR: command parsing: ", err)
 		return err
 	}
-	return session.SendWsMsg(websocket.TextMessage, Message{Handler: "command", Payload: parsedMsg}.Str())
+	return session.sendMessage(Message{Handler: "command", Payload: parsedMsg}, prefix, msg)
 }
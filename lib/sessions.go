@@ -17,8 +17,11 @@
 package lib
 
 import (
+	"context"
+	"encoding/json"
 	"log"
 	"sync"
+	"time"
 )
 
 type SessionsCollection struct {
@@ -49,15 +52,74 @@ func (this *SessionsCollection) GetSessions() (result map[string]*Session) {
 	return
 }
 
+func (this *SessionsCollection) List() (result []*Session) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for _, session := range this.sessions {
+		result = append(result, session)
+	}
+	return
+}
+
+func (this *SessionsCollection) Get(id string) (session *Session, ok bool) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	session, ok = this.sessions[id]
+	return
+}
+
+func (this *SessionsCollection) Count() (sessions int, devices int) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return len(this.sessions), len(this.index)
+}
+
 func (this *SessionsCollection) Dispatch(prefix string, msg string) {
+	sent := false
+	held := false
+	buffered := false
+	var dropped []bufferedCommand
+	var sendErr error
 	this.mux.Lock()
+	sessionCount := len(this.index[prefix])
 	for _, session := range this.index[prefix] {
-		err := session.SendCommand(msg)
+		if session.opening {
+			session.held = append(session.held, bufferedCommand{prefix: prefix, msg: msg, received: time.Now()})
+			held = true
+			continue
+		}
+		err := session.SendCommand(prefix, msg)
 		if err != nil {
 			log.Println("error ", prefix, session.Cred.User, err)
+			sendErr = err
+		} else {
+			sent = true
 		}
 	}
+	if sessionCount == 0 {
+		buffered, dropped = Buffer().Add(prefix, msg)
+	}
 	this.mux.Unlock()
+	reportBufferOverflow(dropped)
+	switch {
+	case sent:
+		trackCommand(prefix, msg)
+	case held:
+		log.Println("hold command until the handshake response is sent", prefix)
+	case buffered:
+		log.Println("buffer command for disconnected device", prefix)
+	case sessionCount == 0:
+		ReportUndeliverableCommand(prefix, msg, UndeliverableNoSession, "no session for device")
+	default:
+		ReportUndeliverableCommand(prefix, msg, UndeliverableSendFailure, sendErr.Error())
+	}
+}
+
+func trackCommand(prefix string, msg string) {
+	command := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(msg), &command); err == nil {
+		Commands().Track(prefix, command)
+	}
 }
 
 func (this *SessionsCollection) Register(session *Session) {
@@ -67,6 +129,8 @@ func (this *SessionsCollection) Register(session *Session) {
 }
 
 func (this *SessionsCollection) RegisterPrefix(session *Session, prefix string) (err error) {
+	var failed []bufferedCommand
+	var sendErrs []error
 	this.mux.Lock()
 	if _, exists := this.index[prefix]; !exists {
 		this.index[prefix] = map[string]*Session{}
@@ -76,22 +140,92 @@ func (this *SessionsCollection) RegisterPrefix(session *Session, prefix string)
 		log.Println("ERROR in RegisterPts(): ", err)
 	} else {
 		this.index[prefix][session.Id] = session
+		var replay []bufferedCommand
+		for _, msg := range Buffer().Take(prefix) {
+			replay = append(replay, bufferedCommand{prefix: prefix, msg: msg, received: time.Now()})
+		}
+		if session.opening {
+			session.held = append(session.held, replay...)
+		} else {
+			//replay while holding the lock to keep buffered commands ahead of new ones
+			failed, sendErrs = sendHeldCommands(session, replay)
+		}
 	}
 	this.mux.Unlock()
+	reportReplayFailures(failed, sendErrs)
 	return
 }
 
+// sends the commands held while the session was opening; called after the handshake response is queued
+func (this *SessionsCollection) Opened(session *Session) {
+	this.mux.Lock()
+	held := session.held
+	session.held = nil
+	session.opening = false
+	//send while holding the lock to keep held commands ahead of new ones
+	failed, sendErrs := sendHeldCommands(session, held)
+	this.mux.Unlock()
+	reportReplayFailures(failed, sendErrs)
+}
+
+// sends buffered or held commands in order; returns the commands that could not be sent
+func sendHeldCommands(session *Session, commands []bufferedCommand) (failed []bufferedCommand, sendErrs []error) {
+	for _, command := range commands {
+		log.Println("replay command", command.prefix)
+		if err := session.SendCommand(command.prefix, command.msg); err != nil {
+			failed = append(failed, command)
+			sendErrs = append(sendErrs, err)
+			continue
+		}
+		trackCommand(command.prefix, command.msg)
+	}
+	return
+}
+
+func reportReplayFailures(failed []bufferedCommand, sendErrs []error) {
+	for i, command := range failed {
+		ReportUndeliverableCommand(command.prefix, command.msg, UndeliverableSendFailure, sendErrs[i].Error())
+	}
+}
+
 func (this *SessionsCollection) Deregister(session *Session) {
 	this.mux.Lock()
+	held := session.held
+	session.held = nil
 	delete(this.sessions, session.Id)
 	for _, prefix := range session.Prefixes {
 		delete(this.index[prefix], session.Id)
 		if len(this.index[prefix]) == 0 {
-			DeregisterPts(prefix)
 			delete(this.index, prefix)
+			if CommandBufferEnabled() && !ShuttingDown() {
+				//keep the pts route until the command buffer ttl expires
+				Buffer().Disconnected(prefix)
+			} else {
+				DeregisterPts(prefix)
+			}
 		}
 	}
 	this.mux.Unlock()
+	//commands held for a session closed before its handshake response go back to the buffer if possible
+	for _, command := range held {
+		buffered, dropped := Buffer().Add(command.prefix, command.msg)
+		reportBufferOverflow(dropped)
+		if !buffered {
+			ReportUndeliverableCommand(command.prefix, command.msg, UndeliverableNoSession, "session closed before its handshake response")
+		}
+	}
+}
+
+// removes the pts route of a disconnected device if no session listens to it again
+func (this *SessionsCollection) ReleasePrefix(prefix string) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if _, exists := this.index[prefix]; !exists {
+		err := DeregisterPts(prefix)
+		if err != nil {
+			log.Println("ERROR in DeregisterPts(): ", err)
+		}
+	}
 }
 
 func (this *SessionsCollection) DeregisterPrefix(session *Session, prefix string) (err error) {
@@ -109,14 +243,31 @@ func (this *SessionsCollection) DeregisterPrefix(session *Session, prefix string
 	return
 }
 
-func (this *SessionsCollection) Close() {
-	log.Println("shuting connector down...")
-	this.mux.Lock()
-	for _, sessionByPrefix := range this.index {
-		for _, session := range sessionByPrefix {
-			session.Close("connector shutdown")
-		}
+// closes all sessions concurrently; returns when all sessions are closed or ctx is done
+func (this *SessionsCollection) Close(ctx context.Context) {
+	log.Println("close all sessions...")
+	drainTimeout := outboxDrainTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < drainTimeout {
+		drainTimeout = time.Until(deadline)
 	}
-	ConnectorLog{Connected: false}.Send()
-	this.mux.Unlock()
+	wg := sync.WaitGroup{}
+	for _, session := range this.List() {
+		wg.Add(1)
+		go func(session *Session) {
+			defer wg.Done()
+			session.closeWithin(shutdownCloseReason, drainTimeout)
+		}(session)
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("WARNING: deadline exceeded while closing sessions")
+	}
+	//streams of http sessions which are still closing would keep the server from shutting down
+	closeHttpStreams()
 }
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+)
+
+func TestDispatch(t *testing.T) {
+	deadLetters := subscribe(t, "dead_letters")
+	responses := subscribe(t, "responses")
+	command := `{"device_instance_id": "device", "task_id": "task", "protocol_parts": []}`
+
+	cases := []struct {
+		name         string
+		connected    bool
+		disconnected bool //recently disconnected; commands are buffered
+		deadLetter   string
+	}{
+		{name: "connected device", connected: true},
+		{name: "recently disconnected device", disconnected: true},
+		{name: "unknown device", deadLetter: UndeliverableNoSession},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			prefix := "device_" + c.name
+			sessions := &SessionsCollection{index: map[string]map[string]*Session{}, sessions: map[string]*Session{}}
+			session := testSession()
+			if c.connected {
+				sessions.index[prefix] = map[string]*Session{session.Id: session}
+			}
+			if c.disconnected {
+				Buffer().Disconnected(prefix)
+				defer Buffer().Take(prefix)
+			}
+
+			sessions.Dispatch(prefix, command)
+
+			if c.connected {
+				if session.QueueDepth() != 1 {
+					t.Fatal("command not sent to session", session.QueueDepth())
+				}
+				msg := Message{}
+				if err := json.Unmarshal((<-session.outbox).data, &msg); err != nil || msg.Handler != "command" {
+					t.Fatal("unexpected outbound message", msg, err)
+				}
+			}
+			if c.disconnected {
+				buffered := Buffer().Take(prefix)
+				if len(buffered) != 1 || buffered[0] != command {
+					t.Fatal("command not buffered", buffered)
+				}
+			}
+			if c.deadLetter == "" {
+				expectNoMessage(t, deadLetters)
+				expectNoMessage(t, responses)
+				return
+			}
+			letter := UndeliverableCommand{}
+			if err := json.Unmarshal(receive(t, deadLetters).Value, &letter); err != nil {
+				t.Fatal(err)
+			}
+			if letter.Reason != c.deadLetter || letter.DeviceId != prefix || letter.Command != command {
+				t.Fatal("unexpected dead letter", letter)
+			}
+			response := map[string]interface{}{}
+			if err := json.Unmarshal(receive(t, responses).Value, &response); err != nil {
+				t.Fatal(err)
+			}
+			if response["task_id"] != "task" {
+				t.Fatal("unexpected error response", response)
+			}
+		})
+	}
+}
+
+func TestReplayAfterHandshakeResponse(t *testing.T) {
+	pts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer pts.Close()
+	withConfig(t, func(config *util.ConfigStruct) {
+		config.PtsUrl = pts.URL
+	})
+	deadLetters := subscribe(t, "dead_letters")
+	prefix := "device_replay"
+	sessions := &SessionsCollection{index: map[string]map[string]*Session{}, sessions: map[string]*Session{}}
+	session := testSession()
+	session.opening = true
+
+	Buffer().Disconnected(prefix)
+	Buffer().Add(prefix, `{"task_id": "buffered"}`)
+	Buffer().Add(prefix, "unparsable command")
+	if err := sessions.RegisterPrefix(session, prefix); err != nil {
+		t.Fatal(err)
+	}
+	sessions.Dispatch(prefix, `{"task_id": "held"}`)
+	if session.QueueDepth() != 0 {
+		t.Fatal("commands must be held until the handshake response is queued", session.QueueDepth())
+	}
+
+	session.SendResponse(Message{Handler: "response", Payload: "handshake"})
+	sessions.Opened(session)
+	sessions.Dispatch(prefix, `{"task_id": "new"}`)
+
+	expected := []string{"response", "buffered", "held", "new"}
+	if session.QueueDepth() != len(expected) {
+		t.Fatal("unexpected queue depth", session.QueueDepth())
+	}
+	for _, name := range expected {
+		msg := Message{}
+		if err := json.Unmarshal((<-session.outbox).data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if name == "response" {
+			if msg.Handler != "response" {
+				t.Fatal("handshake response is not the first message", msg)
+			}
+			continue
+		}
+		command, _ := msg.Payload.(map[string]interface{})
+		if msg.Handler != "command" || command["task_id"] != name {
+			t.Fatal("unexpected message instead of command", name, msg)
+		}
+	}
+
+	letter := UndeliverableCommand{}
+	if err := json.Unmarshal(receive(t, deadLetters).Value, &letter); err != nil {
+		t.Fatal(err)
+	}
+	if letter.Reason != UndeliverableSendFailure || letter.Command != "unparsable command" {
+		t.Fatal("unexpected dead letter", letter)
+	}
+	expectNoMessage(t, deadLetters)
+}
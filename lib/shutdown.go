@@ -0,0 +1,97 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const shutdownCloseReason = "connector shutdown; reconnect elsewhere"
+
+var shuttingDown int32
+var activeHandlers sync.WaitGroup
+
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// rejects new connections, waits until timeout for in-flight handlers, asks gateways to reconnect elsewhere,
+// stops the server, flushes the producer and sends the final connector log
+func Shutdown(timeout time.Duration) {
+	atomic.StoreInt32(&shuttingDown, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	//new connections and requests are answered with 503; responses of in-flight handlers have to be queued before the close message
+	log.Println("shutdown: wait for in-flight handlers")
+	err := waitForHandlers(ctx)
+	if err != nil {
+		log.Println("WARNING: shutdown: ", err)
+	}
+
+	log.Println("shutdown: send close to gateways")
+	sessions := Sessions().List()
+	for _, session := range sessions {
+		err = session.SendCloseCode(websocket.CloseServiceRestart, shutdownCloseReason)
+		if err != nil {
+			log.Println("WARNING: shutdown: unable to send close to", session.Gateway, err)
+		}
+	}
+	Sessions().Close(ctx)
+	StopMqtt()
+
+	//http sessions poll until their session is closed
+	log.Println("shutdown: stop server")
+	err = StopServer(ctx)
+	if err != nil {
+		log.Println("WARNING: shutdown: unable to stop server gracefully", err)
+	}
+
+	log.Println("shutdown: flush producer")
+	CloseProducer()
+
+	err = ConnectorLog{Connected: false}.Send()
+	if err != nil {
+		log.Println("ERROR: shutdown: unable to send connector log", err)
+	}
+	err = ClearPts()
+	if err != nil {
+		log.Println("ERROR: shutdown: unable to clear pts", err)
+	}
+	log.Println("shutdown: done")
+}
+
+func waitForHandlers(ctx context.Context) error {
+	done := make(chan bool)
+	go func() {
+		activeHandlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("deadline exceeded while waiting for in-flight handlers")
+	}
+}
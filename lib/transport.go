@@ -0,0 +1,68 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/gorilla/websocket"
+)
+
+// connection between a session and its gateway
+type Transport interface {
+	Name() string
+	Write(msg outboundMessage) error //called by the single writer of the outbound queue
+	WriteControl(msgType int, data []byte) error
+	Close() error
+	Traffic() *trafficCounter
+}
+
+type wsTransport struct {
+	conn    *websocket.Conn
+	traffic *trafficCounter
+}
+
+func newWsTransport(conn *websocket.Conn) *wsTransport {
+	return &wsTransport{conn: conn, traffic: connectionTraffic(conn)}
+}
+
+func (this *wsTransport) Name() string {
+	return "websocket"
+}
+
+func (this *wsTransport) Write(msg outboundMessage) error {
+	err := this.conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(util.Config.WsTimeout)))
+	if err != nil {
+		return err
+	}
+	this.conn.EnableWriteCompression(compressMessage(msg.data))
+	return this.conn.WriteMessage(msg.msgType, msg.data)
+}
+
+func (this *wsTransport) WriteControl(msgType int, data []byte) error {
+	return this.conn.WriteControl(msgType, data, time.Now().Add(time.Second*time.Duration(util.Config.WsTimeout)))
+}
+
+func (this *wsTransport) Close() error {
+	return this.conn.Close()
+}
+
+func (this *wsTransport) Traffic() *trafficCounter {
+	return this.traffic
+}
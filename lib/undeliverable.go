@@ -0,0 +1,75 @@
+/*
+ * Copyright 2018 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/SmartEnergyPlatform/platform-connector/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	UndeliverableParseError  = "parse_error"
+	UndeliverableNoSession   = "no_session"
+	UndeliverableSendFailure = "send_failure"
+)
+
+var metricUndeliverableCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "connector_undeliverable_commands_total",
+	Help: "Number of commands which could not be delivered to a gateway by reason.",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(metricUndeliverableCommands)
+}
+
+type UndeliverableCommand struct {
+	Reason   string    `json:"reason"`
+	Error    string    `json:"error"`
+	DeviceId string    `json:"device_id,omitempty"`
+	Command  string    `json:"command"`
+	Time     time.Time `json:"time"`
+}
+
+// publishes the command to config.KafkaCommandDeadLetterTopic and an error response to config.KafkaResponseTopic
+func ReportUndeliverableCommand(prefix string, msg string, reason string, desc string) {
+	log.Println("WARNING: undeliverable command", reason, prefix, desc)
+	metricUndeliverableCommands.WithLabelValues(reason).Inc()
+	if util.Config.KafkaCommandDeadLetterTopic != "" {
+		letter, err := json.Marshal(UndeliverableCommand{Reason: reason, Error: desc, DeviceId: prefix, Command: msg, Time: time.Now()})
+		if err == nil {
+			err = Produce(util.Config.KafkaCommandDeadLetterTopic, prefix, string(letter))
+		}
+		if err != nil {
+			log.Println("ERROR: unable to publish undeliverable command", err)
+		}
+	}
+	command := map[string]interface{}{}
+	err := json.Unmarshal([]byte(msg), &command)
+	if err != nil {
+		log.Println("WARNING: no error response for unparsable command", err)
+		return
+	}
+	err = PublishCommandError(command, reason+": "+desc)
+	if err != nil {
+		log.Println("ERROR: unable to publish error response for undeliverable command", err)
+	}
+}
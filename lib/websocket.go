@@ -17,31 +17,93 @@
 package lib
 
 import (
+	"context"
 	"github.com/SmartEnergyPlatform/platform-connector/util"
 	"log"
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var server *http.Server
+var serverMux sync.Mutex
+
 func WsStart() {
-	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }} // allow x origin
+	upgrader := websocket.Upgrader{
+		CheckOrigin:       func(r *http.Request) bool { return true }, // allow x origin
+		Subprotocols:      codecSubprotocols(),
+		EnableCompression: WsCompressionEnabled(),
+	}
+
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/health", healthHandler(livenessChecks))
+	http.HandleFunc("/ready", healthHandler(readinessChecks))
+	if util.Config.AdminPassword != "" {
+		http.HandleFunc("/admin/", adminHandler)
+	}
+	if RestIngressEnabled() {
+		http.HandleFunc("/gateways/", requireClientCertificate(gatewayHttpHandler))
+	}
+	if HttpTransportEnabled() {
+		http.HandleFunc("/sessions", requireClientCertificate(httpSessionHandler))
+		http.HandleFunc("/sessions/", requireClientCertificate(httpSessionHandler))
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		c, err := upgrader.Upgrade(w, r, nil)
+	http.HandleFunc("/", requireClientCertificate(func(w http.ResponseWriter, r *http.Request) {
+		if ShuttingDown() {
+			http.Error(w, shutdownCloseReason, http.StatusServiceUnavailable)
+			return
+		}
+		c, err := upgrader.Upgrade(countingResponseWriter{w}, r, nil)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			log.Print("upgrade:", err)
 			return
 		}
-		NewSession(c)
-	})
+		err = configureCompression(c)
+		if err != nil {
+			log.Println("WARNING: unable to set compression level", err)
+		}
+		NewSession(c, r)
+	}))
 
+	var err error
+	serverMux.Lock()
 	if util.Config.WssPort != "" && util.Config.TlsCertFile != "" && util.Config.TlsKeyFile != "" {
 		log.Println("start wss on port: ", util.Config.WssPort)
-		log.Fatal(http.ListenAndServeTLS(":"+util.Config.WssPort, util.Config.TlsCertFile, util.Config.TlsKeyFile, nil))
+		server = &http.Server{Addr: ":" + util.Config.WssPort}
+		if ClientCertificatesEnabled() {
+			log.Println("client certificates: ", util.Config.TlsClientAuth)
+			server.TLSConfig, err = ClientTlsConfig()
+			if err == nil {
+				err = LoadCertificateMapping()
+			}
+			if err != nil {
+				serverMux.Unlock()
+				log.Fatal(err)
+			}
+		}
+		serverMux.Unlock()
+		err = server.ListenAndServeTLS(util.Config.TlsCertFile, util.Config.TlsKeyFile)
 	} else {
 		log.Println("start ws on port: ", util.Config.WsPort)
-		log.Fatal(http.ListenAndServe(":"+util.Config.WsPort, nil))
+		server = &http.Server{Addr: ":" + util.Config.WsPort}
+		serverMux.Unlock()
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// stops accepting new connections and waits for running requests; hijacked websocket connections are not affected
+func StopServer(ctx context.Context) error {
+	serverMux.Lock()
+	defer serverMux.Unlock()
+	if server == nil {
+		return nil
 	}
+	return server.Shutdown(ctx)
 }
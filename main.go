@@ -23,6 +23,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
 	"syscall"
 
@@ -45,14 +46,17 @@ func main() {
 
 	lib.InitConnectionLog()
 
-	defer lib.ClearPts()
-	defer lib.Sessions().Close()
-
 	go lib.InitConsumer()
 	go lib.WsStart()
 
+	err = lib.StartMqtt()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 	sig := <-shutdown
 	log.Println("received shutdown signal", sig)
+	lib.Shutdown(time.Duration(util.Config.ShutdownTimeout) * time.Second)
 }
@@ -17,6 +17,8 @@
 package model
 
 import (
+	"time"
+
 	"github.com/SmartEnergyPlatform/formatter-lib"
 	iot_model "github.com/SmartEnergyPlatform/iot-device-repository/lib/model"
 )
@@ -45,15 +47,18 @@ type ConnectorDevice struct {
 }
 
 type EventMessage struct {
-	DeviceUri  string               `json:"device_uri"`
-	ServiceUri string               `json:"service_uri"`
+	DeviceUri  string                 `json:"device_uri"`
+	ServiceUri string                 `json:"service_uri"`
 	Value      formatter_lib.EventMsg `json:"value"`
+	Time       *time.Time             `json:"time,omitempty"`       //optional device-side timestamp (RFC 3339)
+	MessageId  string                 `json:"message_id,omitempty"` //optional client-side id used for deduplication
 }
 
 type PrefixMessage struct {
 	DeviceId  string      `json:"device_id,omitempty"`
 	ServiceId string      `json:"service_id,omitempty"`
 	Value     interface{} `json:"value"`
+	Time      *time.Time  `json:"time,omitempty"`
 }
 
 type GatewayRef struct {
@@ -17,8 +17,12 @@
 package util
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
@@ -28,14 +32,28 @@ import (
 )
 
 type ConfigStruct struct {
-	ZookeeperUrl        string //host1:2181,host2:2181/chroot
+	MessageBus          string   //kafka || memory
+	KafkaBrokers        []string //host1:9092,host2:9092; if empty the brokers are discovered with ZookeeperUrl
+	ZookeeperUrl        string   //host1:2181,host2:2181/chroot
 	KafkaResponseTopic  string
 	KafkaEventTopic     string
 	KafkaConsumerTopic  string
 	KafkaSourceTopic    string
 	KafkaDeviceLogTopic string
 
+	KafkaCommandDeadLetterTopic string
+	KafkaEventKey               string //device || device_service || none
+
 	MaxConsecutiveErrors int64
+	MaxEventBatchSize    int64
+	EventMaxPastSkew     int64 //seconds an event time may lie in the past; 0 = unlimited
+	EventMaxFutureSkew   int64 //seconds an event time may lie in the future; 0 = unlimited
+	EventDedupWindow     int64 //seconds a message id is remembered per device; 0 disables deduplication
+
+	CommandTimeout          int64  //seconds; 0 disables the tracking of command responses
+	CommandCorrelationField string //field of the command payload used to match responses
+	CommandBufferSize       int64  //commands buffered per device of a disconnected gateway; 0 disables the buffer
+	CommandBufferTtl        int64  //seconds
 
 	WsPort       string
 	WssPort      string
@@ -44,19 +62,75 @@ type ConfigStruct struct {
 	WsTimeout    int64
 	WsPingperiod int64
 
+	TlsClientAuth        string //client certificates on the wss port: none || optional || require
+	TlsClientCaFile      string //ca bundle used to verify client certificates
+	TlsClientMappingFile string //json list of {"subject"|"san", "user", "gid", "realm"} mapping certificates to platform identities
+
+	WsQueueSize     int64
+	WsQueueOverflow string //drop_oldest || drop_newest || close
+
+	WsCompression          string //permessage-deflate; "true" || "false"
+	WsCompressionLevel     int64  //flate level -2..9; 0 = library default
+	WsCompressionThreshold int64  //bytes; smaller messages are sent uncompressed
+
+	ShutdownTimeout int64
+
 	KafkaTimeout int64
 
+	KafkaProducerRetries int64
+	KafkaSyncAck         string
+	KafkaSyncAckTimeout  int64
+	KafkaDeadLetterTopic string
+	KafkaDeadLetterFile  string
+
+	KafkaTls           string
+	KafkaTlsCaFile     string
+	KafkaTlsCertFile   string
+	KafkaTlsKeyFile    string
+	KafkaTlsSkipVerify string
+	KafkaSaslMechanism string //PLAIN || SCRAM-SHA-256 || SCRAM-SHA-512
+	KafkaSaslUser      string
+	KafkaSaslPassword  string
+
 	SaramaLog string
 
 	IotRepoUrl string
 	PtsUrl     string
 
+	HealthCheckTimeout int64
+
 	FatalKafkaErrors string
 
 	AuthEndpoint             string
 	AuthClientId             string
 	AuthClientSecret         string
 	AuthExpirationTimeBuffer float64
+	AuthPasswordGrant        string   //"true" || "false"; legacy authentication with user and pw
+	AuthRealm                string   //default realm
+	AuthRealms               []string //additional realms selectable in the handshake
+	AuthIssuerUrl            string   //openid issuer; may contain {realm}; default: AuthEndpoint + "/auth/realms/{realm}"
+	AuthAudiences            []string //accepted azp or aud of access tokens; AuthClientId if empty
+	AuthServiceClientId      string   //service account used for client certificates; AuthClientId if empty
+	AuthServiceClientSecret  string
+
+	AdminUser     string
+	AdminPassword string //admin api is disabled if empty
+
+	RestIngress    string //"true" || "false"
+	RestSessionTtl int64  //seconds an authenticated http gateway session is reused; 300 if 0
+
+	HttpTransport      string //"true" || "false"
+	HttpPollWait       int64  //seconds a long-poll waits for messages; 30 if 0
+	HttpSessionTimeout int64  //seconds without poll until a http session is closed; WsTimeout if 0
+	HttpMaxBodySize    int64  //bytes of http request bodies; 1 MiB if 0
+
+	MqttBroker      string //e.g. tcp://mosquitto:1883; mqtt ingress is disabled if empty
+	MqttClientId    string //random if empty
+	MqttUser        string
+	MqttPassword    string
+	MqttTopicPrefix string //unique per connector instance; "connector/" + KafkaConsumerTopic if empty
+	MqttQos         int64
+	MqttIdleTimeout int64 //seconds without messages until a mqtt session is closed; WsTimeout if 0
 
 	AmqpUrl              string
 	AmqpReconnectTimeout int64
@@ -86,12 +160,113 @@ func LoadConfig(location string) error {
 	}
 	HandleEnvironmentVars(&configuration)
 	HandleDefaultValues(&configuration)
+	error = ValidateConfig(&configuration)
+	if error != nil {
+		log.Println("invalid config: ", error)
+		return error
+	}
 	Config = &configuration
 	return nil
 }
 
-func HandleDefaultValues(config ConfigType) {
+func ValidateConfig(config ConfigType) error {
+	if config.KafkaTls != "" && config.KafkaTls != "true" && config.KafkaTls != "false" {
+		return errors.New("KafkaTls must be 'true' or 'false'")
+	}
+	if (config.KafkaTlsCertFile == "") != (config.KafkaTlsKeyFile == "") {
+		return errors.New("KafkaTlsCertFile and KafkaTlsKeyFile have to be set together")
+	}
+	if config.KafkaTls != "true" && (config.KafkaTlsCaFile != "" || config.KafkaTlsCertFile != "") {
+		return errors.New("KafkaTlsCaFile, KafkaTlsCertFile and KafkaTlsKeyFile require KafkaTls = 'true'")
+	}
+	if config.KafkaTlsCaFile != "" {
+		ca, err := ioutil.ReadFile(config.KafkaTlsCaFile)
+		if err != nil {
+			return err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			return errors.New("no valid certificate found in KafkaTlsCaFile " + config.KafkaTlsCaFile)
+		}
+	}
+	if config.KafkaTlsCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(config.KafkaTlsCertFile, config.KafkaTlsKeyFile); err != nil {
+			return errors.New("invalid KafkaTlsCertFile or KafkaTlsKeyFile: " + err.Error())
+		}
+	}
+	switch config.WsQueueOverflow {
+	case "drop_oldest", "drop_newest", "close":
+	default:
+		return errors.New("unknown WsQueueOverflow '" + config.WsQueueOverflow + "'; expected drop_oldest, drop_newest or close")
+	}
+	if config.WsCompressionLevel < -2 || config.WsCompressionLevel > 9 {
+		return errors.New("invalid WsCompressionLevel; expected -2..9")
+	}
+	if config.MqttQos < 0 || config.MqttQos > 2 {
+		return errors.New("invalid MqttQos; expected 0, 1 or 2")
+	}
+	if strings.ContainsAny(config.MqttTopicPrefix, "+#") {
+		return errors.New("invalid MqttTopicPrefix; wildcards are not allowed")
+	}
+	switch config.TlsClientAuth {
+	case "none":
+	case "optional", "require":
+		if config.WssPort == "" || config.TlsCertFile == "" || config.TlsKeyFile == "" {
+			return errors.New("TlsClientAuth requires WssPort, TlsCertFile and TlsKeyFile")
+		}
+		ca, err := ioutil.ReadFile(config.TlsClientCaFile)
+		if err != nil {
+			return err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			return errors.New("no valid certificate found in TlsClientCaFile " + config.TlsClientCaFile)
+		}
+		if _, err := ioutil.ReadFile(config.TlsClientMappingFile); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown TlsClientAuth '" + config.TlsClientAuth + "'; expected none, optional or require")
+	}
+	switch config.KafkaSaslMechanism {
+	case "":
+	case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		if config.KafkaSaslUser == "" {
+			return errors.New("KafkaSaslMechanism requires KafkaSaslUser")
+		}
+	default:
+		return errors.New("unknown KafkaSaslMechanism '" + config.KafkaSaslMechanism + "'; expected PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512")
+	}
+	return nil
+}
 
+func HandleDefaultValues(config ConfigType) {
+	if config.MessageBus == "" {
+		config.MessageBus = "kafka"
+	}
+	if config.WsQueueOverflow == "" {
+		config.WsQueueOverflow = "drop_oldest"
+	}
+	if config.CommandCorrelationField == "" {
+		config.CommandCorrelationField = "task_id"
+	}
+	if config.AuthRealm == "" {
+		config.AuthRealm = "master"
+	}
+	if config.AuthPasswordGrant == "" {
+		config.AuthPasswordGrant = "true"
+	}
+	if config.TlsClientAuth == "" {
+		config.TlsClientAuth = "none"
+	}
+	if config.MqttTopicPrefix == "" {
+		//every instance needs its own topics; otherwise all instances would open a session for every gateway
+		config.MqttTopicPrefix = strings.TrimSuffix("connector/"+config.KafkaConsumerTopic, "/")
+	}
+	if config.KafkaEventKey == "" {
+		config.KafkaEventKey = "device"
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = 10
+	}
 }
 
 var camel = regexp.MustCompile("(^[^A-Z]*|[A-Z]*)([A-Z][^A-Z]+|$)")